@@ -1,8 +1,8 @@
 package engine
 
 import (
-	"errors"
 	"fmt"
+	"math"
 	"strconv"
 )
 
@@ -10,21 +10,48 @@ import (
 type AST struct {
 	Tokens []*Token
 
+	engine    *Engine
 	source    string
 	currTok   *Token
 	currIndex int
 	depth     int
+	// nesting is the depth of the operand being parsed, bounded by Limits.MaxDepth
+	nesting int
+	limits  Limits
+	// prevEnd is the end offset of the last consumed token
+	prevEnd int
+	// recovering keeps parsing after an error, see Engine.Check
+	recovering bool
+	// imaginary resolves the name i to the imaginary unit, it is only set by EvalComplex
+	imaginary bool
 
+	// Err is the first error found
 	Err error
+	// Diagnostics lists every error found, the parser only goes on after the first one when recovering
+	Diagnostics []Diagnostic
 }
 
+// NewAST create an AST resolving functions and constants with the default engine
 func NewAST(toks []*Token, s string) *AST {
+	return std.NewAST(toks, s)
+}
+
+// NewAST create an AST resolving functions and constants with this engine
+func (e *Engine) NewAST(toks []*Token, s string) *AST {
 	a := &AST{
 		Tokens: toks,
+		engine: e,
 		source: s,
+		limits: e.Limits,
 	}
 	if a.Tokens == nil || len(a.Tokens) == 0 {
-		a.Err = errors.New("empty token")
+		a.report(&SyntaxError{code: CodeEmptyExpression, Msg: "empty token"})
+	} else if max := a.limits.MaxLength; max > 0 && len(s) > max {
+		a.report(&LimitError{Span: Span{max, len(s)}, Limit: "MaxLength", Max: max})
+		a.Tokens = nil
+	} else if max := a.limits.MaxTokens; max > 0 && len(toks) > max {
+		a.report(&LimitError{Span: Span{toks[max].Offset, len(s)}, Limit: "MaxTokens", Max: max})
+		a.Tokens = nil
 	} else {
 		a.currIndex = 0
 		a.currTok = a.Tokens[0]
@@ -33,19 +60,107 @@ func NewAST(toks []*Token, s string) *AST {
 }
 
 func (a *AST) ParseExpression() ExprNode {
+	if len(a.Tokens) == 0 {
+		return nil
+	}
 	a.depth++ // called depth
-	lhs := a.parsePrimary()
-	r := a.parseBinOpRHS(0, lhs)
+	r := a.parseExpr(0)
 	a.depth--
-	if a.depth == 0 && a.currIndex != len(a.Tokens) && a.Err == nil {
-		a.Err = errors.New(
-			fmt.Sprintf("bad expression, reaching the end or missing the operator\n%s",
-				ErrPos(a.source, a.currTok.Offset)))
+	if a.depth == 0 && !a.eof() && (a.Err == nil || a.recovering) {
+		a.report(newSyntaxError(CodeUnexpectedToken, a.currTok,
+			"bad expression, reaching the end or missing the operator"))
+		if a.recovering {
+			r = a.recoverTail(r)
+		}
+	}
+	return r
+}
+
+// report record a parse error, Err keeps the first one
+func (a *AST) report(err error) {
+	if a.Err != nil && !a.recovering {
+		return
+	}
+	if a.Err == nil {
+		a.Err = err
+	}
+	d := newDiagnostic(SeverityError, err)
+	// an error at the same place as the previous one is a consequence of it
+	if n := len(a.Diagnostics); n > 0 && a.Diagnostics[n-1].Start == d.Start {
+		return
+	}
+	a.Diagnostics = append(a.Diagnostics, d)
+}
+
+// fail record err and returns the node standing for the unparsable input:
+// nil normally, a BadExprNode covering the skipped tokens when recovering
+func (a *AST) fail(err error) ExprNode {
+	a.report(err)
+	if !a.recovering {
+		return nil
+	}
+	return BadExprNode{Span: a.synchronize(), Err: err}
+}
+
+// synchronize skip tokens up to the next ',' or ')' of the current nesting level,
+// returns the span of the skipped tokens
+func (a *AST) synchronize() Span {
+	start := len(a.source)
+	if !a.eof() {
+		start = a.currTok.Offset
+	}
+	end := start
+	level := 0
+	for !a.eof() {
+		if level == 0 && (a.currTok.Type == COMMA || a.currTok.Value == ")" || a.currTok.Value == "]") {
+			break
+		}
+		if a.currTok.Value == "(" || a.currTok.Value == "[" {
+			level++
+		} else if a.currTok.Value == ")" || a.currTok.Value == "]" {
+			level--
+		}
+		a.getNextToken()
+		end = a.prevEnd
+	}
+	return Span{start, end}
+}
+
+// recoverTail go on after a complete top level expression followed by unexpected tokens,
+// a stray ')' is skipped and the expression continues with the operator after it
+func (a *AST) recoverTail(r ExprNode) ExprNode {
+	for !a.eof() {
+		a.synchronize()
+		if a.eof() {
+			break
+		}
+		a.getNextToken()
+		if a.eof() {
+			break
+		}
+		a.depth++
+		r = a.parseInfix(0, r)
+		a.depth--
 	}
 	return r
 }
 
+// eof returns whether all tokens have been consumed
+func (a *AST) eof() bool {
+	return a.currIndex >= len(a.Tokens)
+}
+
+// eofError an unexpected end of input, positioned right after the source
+func (a *AST) eofError(format string, args ...interface{}) error {
+	return &SyntaxError{
+		Span: Span{len(a.source), len(a.source)},
+		code: CodeUnexpectedEOF,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
 func (a *AST) getNextToken() *Token {
+	a.prevEnd = a.currTok.End
 	a.currIndex++
 	if a.currIndex < len(a.Tokens) {
 		a.currTok = a.Tokens[a.currIndex]
@@ -54,28 +169,17 @@ func (a *AST) getNextToken() *Token {
 	return nil
 }
 
-func (a *AST) getTokPrecedence() int {
-	key := a.currTok.Value[0]
-	if p, ok := operators[key]; ok {
-		return p.Precedence()
-	}
-	return -1
-}
-
 // 解析Number值
-func (a *AST) parseNumber() NumberExprNode {
+func (a *AST) parseNumber() ExprNode {
 	f64, err := strconv.ParseFloat(a.currTok.Value, 64)
 	if err != nil {
-		a.Err = errors.New(
-			fmt.Sprintf("%v\nwant '(' or '0-9' but get '%s'\n%s",
-				err.Error(),
-				a.currTok.Value,
-				ErrPos(a.source, a.currTok.Offset)))
-		return NumberExprNode{}
+		return a.fail(newSyntaxError(CodeBadNumber, a.currTok,
+			"%v\nwant '(' or '0-9' but get '%s'", err, a.currTok.Value))
 	}
 	n := NumberExprNode{
-		Val: f64,
-		Str: a.currTok.Value,
+		Span: Span{a.currTok.Offset, a.currTok.End},
+		Val:  f64,
+		Str:  a.currTok.Value,
 	}
 	a.getNextToken()
 	return n
@@ -83,163 +187,283 @@ func (a *AST) parseNumber() NumberExprNode {
 
 // 解析函数或常量
 func (a *AST) parseFunCallerOrConst() ExprNode {
+	if a.atUnit() {
+		// a unit alone, e.g. the target of to(x, km/h)
+		if _, ok := a.engine.lookupConst(a.currTok.Value); !ok {
+			return a.parseQuantity(nil)
+		}
+	}
 	name := a.currTok.Value
+	start := a.currTok.Offset
 	a.getNextToken()
 	// call func，如果下一个节点为(表示该节点为函数，否则为常量值
-	if a.currTok.Value == "(" {
-		f := FunCallerExprNode{}
-		if _, ok := defFunc[name]; !ok {
-			a.Err = errors.New(
-				fmt.Sprintf("function `%s` is undefined\n%s",
-					name,
-					ErrPos(a.source, a.currTok.Offset)))
-			return f
+	if !a.eof() && a.currTok.Value == "(" {
+		def, ok := a.engine.lookupFunc(name)
+		if !ok {
+			a.report(&UndefinedFunctionError{Span: Span{start, a.prevEnd}, Name: name})
+			if !a.recovering {
+				return FunCallerExprNode{}
+			}
 		}
 		a.getNextToken()
-		exprs := make([]ExprNode, 0)
-		if a.currTok.Value == ")" {
-			// function call without parameters
-			// ignore the process of parameter resolution
-		} else {
-			exprs = append(exprs, a.ParseExpression())
-			for a.currTok.Value != ")" && a.getNextToken() != nil {
-				if a.currTok.Type == COMMA {
-					continue
-				}
-				exprs = append(exprs, a.ParseExpression())
-			}
+		exprs, complete := a.parseArgs()
+		if !complete && !a.recovering {
+			return nil
+		}
+		f := FunCallerExprNode{
+			Span: Span{start, a.prevEnd},
+			Name: name,
+			Arg:  exprs,
 		}
-		def := defFunc[name]
 		// 校验函数参数
-		if def.argc >= 0 && len(exprs) != def.argc {
-			a.Err = errors.New(
-				fmt.Sprintf("wrong way calling function `%s`, parameters want %d but get %d\n%s",
-					name,
-					def.argc,
-					len(exprs),
-					ErrPos(a.source, a.currTok.Offset)))
+		if ok && def.argc >= 0 && len(exprs) != def.argc {
+			a.report(&ArityError{Span: f.Span, Name: name, Want: def.argc, Got: len(exprs)})
 		}
-		a.getNextToken()
-		f.Name = name
-		f.Arg = exprs
 		return f
 	}
 
 	// call const
-	if v, ok := defConst[name]; ok {
-		return ConstExprNode{
-			Name: name,
-			Val:  v,
-			Str:  strconv.FormatFloat(v, 'f', 0, 64),
+	v, ok := a.engine.lookupConst(name)
+	if !ok && a.imaginary && name == "i" {
+		// the value is not used, see complexMode
+		v, ok = math.NaN(), true
+	}
+	if !ok {
+		a.report(&UndefinedConstError{Span: Span{start, a.prevEnd}, Name: name})
+		if !a.recovering {
+			return NumberExprNode{}
 		}
-	} else {
-		a.Err = errors.New(
-			fmt.Sprintf("const `%s` is undefined\n%s",
-				name,
-				ErrPos(a.source, a.currTok.Offset)))
-		return NumberExprNode{}
-	}
-}
-
-// 解析操作符
-func (a *AST) parseOperator() ExprNode {
-	if a.currTok.Value == "(" {
-		t := a.getNextToken()
-		if t == nil {
-			a.Err = errors.New(
-				fmt.Sprintf("want '(' or '0-9' but get EOF\n%s",
-					ErrPos(a.source, a.currTok.Offset)))
-			return nil
+	}
+	return ConstExprNode{
+		Span: Span{start, a.prevEnd},
+		Name: name,
+		Val:  v,
+		Str:  strconv.FormatFloat(v, 'f', 0, 64),
+	}
+}
+
+// parseArgs 解析函数参数直到 ')'
+// complete is false if the argument list is broken, when recovering the parsable arguments are still returned
+func (a *AST) parseArgs() (exprs []ExprNode, complete bool) {
+	return a.parseItems(")")
+}
+
+// parseItems parse the expressions separated by ',' up to close, the function arguments and the list items
+func (a *AST) parseItems(close string) (exprs []ExprNode, complete bool) {
+	exprs = make([]ExprNode, 0)
+	if !a.eof() && a.currTok.Value == close {
+		// function call without parameters
+		// ignore the process of parameter resolution
+		a.getNextToken()
+		return exprs, true
+	}
+	complete = true
+	for {
+		arg := a.ParseExpression()
+		if arg == nil {
+			return exprs, false
 		}
-		e := a.ParseExpression()
-		if e == nil {
-			return nil
+		exprs = append(exprs, arg)
+		if max := a.limits.MaxArgs; max > 0 && len(exprs) == max+1 {
+			a.report(&LimitError{Span: arg.Pos(), Limit: "MaxArgs", Max: max})
+			if !a.recovering {
+				return exprs, false
+			}
 		}
-		if a.currTok.Value != ")" {
-			a.Err = errors.New(
-				fmt.Sprintf("want ')' but get %s\n%s",
-					a.currTok.Value,
-					ErrPos(a.source, a.currTok.Offset)))
-			return nil
+		if a.eof() {
+			a.report(a.eofError("want '%s' but get EOF", close))
+			return exprs, false
+		}
+		if a.currTok.Type == COMMA {
+			a.getNextToken()
+			continue
+		}
+		if a.currTok.Value == close {
+			a.getNextToken()
+			return exprs, complete
+		}
+		a.report(newSyntaxError(CodeUnexpectedToken, a.currTok, "want ',' or '%s' but get %s", close, a.currTok.Value))
+		if !a.recovering {
+			return exprs, false
+		}
+		complete = false
+		a.synchronize()
+		if a.eof() {
+			return exprs, false
+		}
+		if a.currTok.Value == close {
+			a.getNextToken()
+			return exprs, false
 		}
 		a.getNextToken()
-		return e
-	} else if a.currTok.Value == "-" {
-		if a.getNextToken() == nil {
-			a.Err = errors.New(
-				fmt.Sprintf("want '0-9' but get '-'\n%s",
-					ErrPos(a.source, a.currTok.Offset)))
-			return nil
+	}
+}
+
+// 解析以操作符开头的操作数，例如 (a)、[a, b] 与 -a
+func (a *AST) parsePrefix() ExprNode {
+	rule, ok := a.engine.prefixRule(a.currTok.Value)
+	if !ok {
+		return a.fail(newSyntaxError(CodeUnexpectedToken, a.currTok, "want '(' or '0-9' but get '%s'", a.currTok.Value))
+	}
+	tok := a.currTok
+	a.getNextToken()
+	return rule.parse(a, tok)
+}
+
+// atUnit reports whether the token at the current position names a unit and is not a function call
+func (a *AST) atUnit() bool {
+	return a.unitAt(a.currIndex)
+}
+
+func (a *AST) unitAt(i int) bool {
+	if i >= len(a.Tokens) || a.Tokens[i].Type != IDENTIFIER || !isUnitName(a.Tokens[i].Value) {
+		return false
+	}
+	return i+1 >= len(a.Tokens) || a.Tokens[i+1].Value != "("
+}
+
+// 解析单位，val 为数值，单独的单位时为 nil
+// the unit is made of named units with integer powers joined by '*' and '/', e.g. kg*m/s^2,
+// it goes on after '*' or '/' only if a unit follows, so 3 m / 2 s is a quotient of two quantities
+func (a *AST) parseQuantity(val ExprNode) ExprNode {
+	start := a.currTok.Offset
+	if val != nil {
+		start = val.Pos().Start
+	}
+	var u Unit
+	sign := 1
+	for {
+		name := a.currTok.Value
+		a.getNextToken()
+		u = u.with(name, sign*a.parseUnitPower())
+		if a.eof() || a.currTok.Value != "*" && a.currTok.Value != "/" || !a.unitAt(a.currIndex+1) {
+			return QuantityExprNode{Span: Span{start, a.prevEnd}, Val: val, Unit: u}
 		}
-		bin := OperatorExprNode{
-			Op:  "-",
-			Lhs: NumberExprNode{},
-			Rhs: a.parsePrimary(),
+		sign = 1
+		if a.currTok.Value == "/" {
+			sign = -1
 		}
-		return bin
-	} else {
-		return a.parseNumber()
+		a.getNextToken()
 	}
 }
 
+// parseUnitPower parse the integer power after a unit such as s^2 or m^-1, 1 if there is none
+func (a *AST) parseUnitPower() int {
+	if a.eof() || a.currTok.Value != "^" {
+		return 1
+	}
+	i, sign := a.currIndex+1, 1
+	if i < len(a.Tokens) && a.Tokens[i].Value == "-" {
+		i, sign = i+1, -1
+	}
+	if i >= len(a.Tokens) || a.Tokens[i].Type != LITERAL {
+		return 1
+	}
+	n, err := strconv.Atoi(a.Tokens[i].Value)
+	if err != nil {
+		return 1
+	}
+	for a.currIndex <= i {
+		a.getNextToken()
+	}
+	return sign * n
+}
+
 // 解析变量
 func (a *AST) parseVariable() ExprNode {
 	n := VariableExprNode{
-		Val: a.currTok.Value,
+		Span: Span{a.currTok.Offset, a.currTok.End},
+		Val:  a.currTok.Value,
 	}
 	a.getNextToken()
 	return n
 }
 
 func (a *AST) parsePrimary() ExprNode {
+	if a.eof() {
+		return a.fail(a.eofError("want '(' or '0-9' but get EOF"))
+	}
+	a.nesting++
+	defer func() { a.nesting-- }()
+	if max := a.limits.MaxDepth; max > 0 && a.nesting > max {
+		return a.fail(&LimitError{Span: Span{a.currTok.Offset, a.currTok.End}, Limit: "MaxDepth", Max: max})
+	}
 	switch a.currTok.Type {
 	case IDENTIFIER:
 		return a.parseFunCallerOrConst()
 	case LITERAL:
-		return a.parseNumber()
+		n := a.parseNumber()
+		if n == nil || !a.atUnit() {
+			return n
+		}
+		return a.parseQuantity(n)
 	case OPERATOR:
-		return a.parseOperator()
+		return a.parsePrefix()
 	case VARIABLE:
 		return a.parseVariable()
 	case COMMA:
-		a.Err = errors.New(
-			fmt.Sprintf("want '(' or '0-9' but get %s\n%s",
-				a.currTok.Value,
-				ErrPos(a.source, a.currTok.Offset)))
-		return nil
+		return a.fail(newSyntaxError(CodeUnexpectedToken, a.currTok, "want '(' or '0-9' but get %s", a.currTok.Value))
 	default:
 		return nil
 	}
 }
 
-func (a *AST) parseBinOpRHS(execPrec int, lhs ExprNode) ExprNode {
-	for {
-		tokPrec := a.getTokPrecedence()
-		if tokPrec < execPrec {
+// parseExpr parse an operand and the operators after it binding at least as tight as power
+func (a *AST) parseExpr(power int) ExprNode {
+	lhs := a.parsePrimary()
+	if lhs == nil {
+		return nil
+	}
+	return a.parseInfix(power, lhs)
+}
+
+// parseNested same as parseExpr for an operand one level deeper in the tree,
+// such as the right operand of a binary operator, bounded by Limits.MaxDepth
+func (a *AST) parseNested(power int) ExprNode {
+	a.nesting++
+	defer func() { a.nesting-- }()
+	if max := a.limits.MaxDepth; max > 0 && a.nesting > max && !a.eof() {
+		return a.fail(&LimitError{Span: Span{a.currTok.Offset, a.currTok.End}, Limit: "MaxDepth", Max: max})
+	}
+	return a.parseExpr(power)
+}
+
+// infixRule returns the rule of the current token if it continues an operand
+func (a *AST) infixRule() (infixRule, bool) {
+	if a.eof() {
+		return infixRule{}, false
+	}
+	return a.engine.infixRule(a.currTok.Value, a.operandAt(a.currIndex+1))
+}
+
+// operandAt reports whether the token i can only start an operand: a number, a variable, a name or '('.
+// a prefix operator such as - is not one, it may as well be binary
+func (a *AST) operandAt(i int) bool {
+	if i >= len(a.Tokens) {
+		return false
+	}
+	tok := a.Tokens[i]
+	if tok.Type != OPERATOR {
+		return tok.Type != COMMA
+	}
+	return tok.Value == "("
+}
+
+// parseInfix apply the infix, postfix and mixfix rules binding at least as tight as power to lhs
+// every rule applied makes lhs one level deeper, a long chain such as 1+1+...+1 is bounded by Limits.MaxDepth
+func (a *AST) parseInfix(power int, lhs ExprNode) ExprNode {
+	for height := a.nesting + 1; ; height++ {
+		rule, ok := a.infixRule()
+		if !ok || rule.power < power {
 			return lhs
 		}
-		binOp := a.currTok.Value
-		if a.getNextToken() == nil {
-			a.Err = errors.New(
-				fmt.Sprintf("want '(' or '0-9' but get EOF\n%s",
-					ErrPos(a.source, a.currTok.Offset)))
-			return nil
+		if max := a.limits.MaxDepth; max > 0 && height > max {
+			return a.fail(&LimitError{Span: Span{a.currTok.Offset, a.currTok.End}, Limit: "MaxDepth", Max: max})
 		}
-		rhs := a.parsePrimary()
-		if rhs == nil {
+		tok := a.currTok
+		a.getNextToken()
+		if lhs = rule.parse(a, lhs, tok); lhs == nil {
 			return nil
 		}
-		nextPrec := a.getTokPrecedence()
-		if tokPrec < nextPrec {
-			rhs = a.parseBinOpRHS(tokPrec+1, rhs)
-			if rhs == nil {
-				return nil
-			}
-		}
-		lhs = OperatorExprNode{
-			Op:  binOp,
-			Lhs: lhs,
-			Rhs: rhs,
-		}
 	}
 }
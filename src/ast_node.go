@@ -1,77 +1,265 @@
 package engine
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // ExprNode 抽象语法树
+// nodes are immutable values, use WithChildren or Rewrite to build a modified tree
 type ExprNode interface {
-	toStr() string
+	String() string
+	// Pos returns the source range covered by the node
+	Pos() Span
+	// Children returns the direct sub-expressions in evaluation order
+	Children() []ExprNode
+	// WithChildren returns a copy of the node with its sub-expressions replaced,
+	// children must have the same length as Children()
+	WithChildren(children []ExprNode) ExprNode
+}
+
+// Span 节点在源码中的区间 [Start, End)
+type Span struct {
+	Start int
+	End   int
+}
+
+// Pos returns the span itself, nodes embedding Span implement ExprNode.Pos with it
+func (s Span) Pos() Span {
+	return s
+}
+
+// ResultNode custom node kinds implement it to take part in ExprASTResult
+type ResultNode interface {
+	ExprNode
+	Result(e *Engine, params map[string]float64) float64
+}
+
+// LaTexNode custom node kinds implement it to take part in ExprASTLaTex
+type LaTexNode interface {
+	ExprNode
+	LaTex(e *Engine) string
 }
 
 // NumberExprNode 数值节点
 type NumberExprNode struct {
+	Span
 	Val float64
 	Str string
 }
 
-func (n NumberExprNode) toStr() string {
+func (n NumberExprNode) String() string {
 	return fmt.Sprintf(
 		"NumberExprNode:%s",
 		n.Str,
 	)
 }
 
+func (n NumberExprNode) Children() []ExprNode {
+	return nil
+}
+
+func (n NumberExprNode) WithChildren([]ExprNode) ExprNode {
+	return n
+}
+
 // OperatorExprNode 操作(二叉树)节点
 type OperatorExprNode struct {
+	Span
 	Op  string
 	Lhs ExprNode
 	Rhs ExprNode
 }
 
-func (o OperatorExprNode) toStr() string {
+func (o OperatorExprNode) String() string {
 	return fmt.Sprintf(
 		"OperatorExprNode: (%s %s %s)",
 		o.Op,
-		o.Lhs.toStr(),
-		o.Rhs.toStr(),
+		o.Lhs.String(),
+		o.Rhs.String(),
 	)
 }
 
+func (o OperatorExprNode) Children() []ExprNode {
+	return []ExprNode{o.Lhs, o.Rhs}
+}
+
+func (o OperatorExprNode) WithChildren(children []ExprNode) ExprNode {
+	o.Lhs, o.Rhs = children[0], children[1]
+	return o
+}
+
 // FunCallerExprNode 函数表达式节点
 type FunCallerExprNode struct {
+	Span
 	Name string
 	Arg  []ExprNode
 }
 
-func (f FunCallerExprNode) toStr() string {
+func (f FunCallerExprNode) String() string {
+	args := make([]string, len(f.Arg))
+	for i, arg := range f.Arg {
+		args[i] = arg.String()
+	}
 	return fmt.Sprintf(
-		"FunCallerExprNode:%s",
+		"FunCallerExprNode:%s(%s)",
 		f.Name,
+		strings.Join(args, ", "),
 	)
 }
 
+func (f FunCallerExprNode) Children() []ExprNode {
+	return f.Arg
+}
+
+func (f FunCallerExprNode) WithChildren(children []ExprNode) ExprNode {
+	f.Arg = append([]ExprNode(nil), children...)
+	return f
+}
+
 // VariableExprNode 数值节点
 type VariableExprNode struct {
+	Span
 	Val string
 }
 
-func (v VariableExprNode) toStr() string {
+func (v VariableExprNode) String() string {
 	return fmt.Sprintf(
 		"VariableExprNode:%s",
 		v.Val,
 	)
 }
 
+func (v VariableExprNode) Children() []ExprNode {
+	return nil
+}
+
+func (v VariableExprNode) WithChildren([]ExprNode) ExprNode {
+	return v
+}
+
 // ConstExprNode 常量节点
 type ConstExprNode struct {
+	Span
 	Name string
 	Str  string
 	Val  float64
 }
 
-func (c ConstExprNode) toStr() string {
+func (c ConstExprNode) String() string {
 	return fmt.Sprintf(
 		"ConstExprNode:%s=%s",
 		c.Name,
 		c.Str,
 	)
 }
+
+func (c ConstExprNode) Children() []ExprNode {
+	return nil
+}
+
+func (c ConstExprNode) WithChildren([]ExprNode) ExprNode {
+	return c
+}
+
+// ListExprNode 列表节点，[1, 2, 3] 为向量，[[1, 2], [3, 4]] 为矩阵
+type ListExprNode struct {
+	Span
+	Items []ExprNode
+}
+
+func (l ListExprNode) String() string {
+	items := make([]string, len(l.Items))
+	for i, item := range l.Items {
+		items[i] = item.String()
+	}
+	return fmt.Sprintf(
+		"ListExprNode:[%s]",
+		strings.Join(items, ", "),
+	)
+}
+
+func (l ListExprNode) Children() []ExprNode {
+	return l.Items
+}
+
+func (l ListExprNode) WithChildren(children []ExprNode) ExprNode {
+	l.Items = append([]ExprNode(nil), children...)
+	return l
+}
+
+// QuantityExprNode 带单位的数值节点，例如 3 m 或 5 km/h
+// Val is nil for a unit alone such as the target of to(x, m/s)
+type QuantityExprNode struct {
+	Span
+	Val  ExprNode
+	Unit Unit
+}
+
+func (q QuantityExprNode) String() string {
+	if q.Val == nil {
+		return fmt.Sprintf("QuantityExprNode:%s", q.Unit)
+	}
+	return fmt.Sprintf(
+		"QuantityExprNode:%s %s",
+		q.Val.String(),
+		q.Unit,
+	)
+}
+
+func (q QuantityExprNode) Children() []ExprNode {
+	if q.Val == nil {
+		return nil
+	}
+	return []ExprNode{q.Val}
+}
+
+func (q QuantityExprNode) WithChildren(children []ExprNode) ExprNode {
+	if q.Val != nil {
+		q.Val = children[0]
+	}
+	return q
+}
+
+// withSpan returns a copy of a builtin node covering span, other node kinds are returned as is
+func withSpan(node ExprNode, span Span) ExprNode {
+	switch n := node.(type) {
+	case NumberExprNode:
+		n.Span = span
+		return n
+	case OperatorExprNode:
+		n.Span = span
+		return n
+	case FunCallerExprNode:
+		n.Span = span
+		return n
+	case VariableExprNode:
+		n.Span = span
+		return n
+	case ConstExprNode:
+		n.Span = span
+		return n
+	case ListExprNode:
+		n.Span = span
+		return n
+	case QuantityExprNode:
+		n.Span = span
+		return n
+	}
+	return node
+}
+
+// cover returns the span from the start of l to the end of r, nil nodes are skipped
+func cover(l, r ExprNode) Span {
+	var s Span
+	if l != nil {
+		s = l.Pos()
+	}
+	if r != nil {
+		if l == nil {
+			s.Start = r.Pos().Start
+		}
+		s.End = r.Pos().End
+	}
+	return s
+}
@@ -0,0 +1,574 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// DefaultPrecision is the mantissa size in bits used by EvalBig when Engine.Precision is 0
+const DefaultPrecision = 256
+
+const (
+	// maxReduceBits bounds the exponent of the argument of a trigonometric function,
+	// removing the multiples of 2π from a larger one is ErrBigTooLarge
+	maxReduceBits = 1 << 14
+	// maxBigFactorial bounds the argument of the factorials, a larger one is ErrBigTooLarge
+	maxBigFactorial = 1 << 16
+)
+
+// BigFloat 任意精度浮点数，由 EvalBig 产生
+type BigFloat struct {
+	*big.Float
+}
+
+func (x BigFloat) Kind() Kind {
+	return BigKind
+}
+
+// String returns the decimal digits allowed by the precision, trailing zeros removed
+func (x BigFloat) String() string {
+	digits := int(float64(x.Prec()) * math.Log10(2))
+	s := x.Text('g', digits)
+	if strings.ContainsAny(s, "e") || !strings.Contains(s, ".") {
+		return s
+	}
+	return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+}
+
+func (x BigFloat) rank() int {
+	return rankBig
+}
+
+func (x BigFloat) float() (float64, bool) {
+	f, _ := x.Float64()
+	return f, true
+}
+
+// toBig convert a number of a lower rank, prec is the precision of the result
+func toBig(v Value, prec uint) *big.Float {
+	switch v := v.(type) {
+	case BigFloat:
+		return v.Float
+	case Integer:
+		return new(big.Float).SetPrec(prec).SetInt64(int64(v))
+	case Rational:
+		return new(big.Float).SetPrec(prec).SetRat(v.Rat)
+	case Decimal:
+		return new(big.Float).SetPrec(prec).SetRat(v.Rat())
+	case Number:
+		if math.IsNaN(float64(v)) {
+			panic(errors.New("NaN can not be represented with big.Float"))
+		}
+		return new(big.Float).SetPrec(prec).SetFloat64(float64(v))
+	}
+	f, _ := toFloat(v)
+	return toBig(Number(f), prec)
+}
+
+// bigOperands returns a and b as *big.Float and the precision of the result
+func bigOperands(a, b Value) (*big.Float, *big.Float, uint) {
+	var prec uint
+	if x, ok := a.(BigFloat); ok {
+		prec = x.Prec()
+	}
+	if y, ok := b.(BigFloat); ok && y.Prec() > prec {
+		prec = y.Prec()
+	}
+	return toBig(a, prec), toBig(b, prec), prec
+}
+
+func (x BigFloat) binary(op string, a, b Value) (Value, bool) {
+	l, r, prec := bigOperands(a, b)
+	z := new(big.Float).SetPrec(prec)
+	switch op {
+	case "+":
+		z.Add(l, r)
+	case "-":
+		z.Sub(l, r)
+	case "*":
+		z.Mul(l, r)
+	case "/":
+		if r.Sign() == 0 {
+			lf, _ := l.Float64()
+			panic(&DivisionByZeroError{Op: "/", Lhs: lf, Rhs: 0})
+		}
+		z.Quo(l, r)
+	case "%":
+		li, _ := l.Int(nil)
+		ri, _ := r.Int(nil)
+		if ri.Sign() == 0 {
+			lf, _ := l.Float64()
+			panic(&DivisionByZeroError{Op: "%", Lhs: lf, Rhs: 0})
+		}
+		z.SetInt(li.Rem(li, ri))
+	case "^":
+		z = bigPow(l, r, prec)
+	default:
+		return nil, false
+	}
+	return BigFloat{z}, true
+}
+
+func (x BigFloat) cmp(a, b Value) (int, bool) {
+	l, r, _ := bigOperands(a, b)
+	return l.Cmp(r), true
+}
+
+func (x BigFloat) call(name string) (Value, bool) {
+	prec := x.Prec()
+	var z *big.Float
+	switch name {
+	case "abs":
+		z = new(big.Float).SetPrec(prec).Abs(x.Float)
+	case "ceil", "floor", "round":
+		z = bigRound(name, x.Float)
+	case "sqrt":
+		if x.Sign() < 0 {
+			panic(errors.New("sqrt of a negative number is not a real number"))
+		}
+		z = new(big.Float).SetPrec(prec).Sqrt(x.Float)
+	case "cbrt":
+		z = bigCbrt(x.Float)
+	case "ln":
+		z = bigLog(x.Float)
+	case "lg":
+		z = bigLog(x.Float)
+		z.Quo(z, bigLog(new(big.Float).SetPrec(prec).SetInt64(10)))
+	case "rad":
+		z = new(big.Float).SetPrec(prec).Mul(x.Float, bigPi(prec))
+		z.Quo(z, new(big.Float).SetInt64(180))
+	case "sin":
+		z = bigSin(x.Float)
+	case "cos":
+		z = bigCos(x.Float)
+	case "tan", "cot", "sec", "csc":
+		z = bigTrigRatio(name, x.Float)
+	case "re", "conj":
+		z = new(big.Float).SetPrec(prec).Set(x.Float)
+	case "im":
+		z = newBig(prec)
+	case "arg":
+		z = newBig(prec)
+		if x.Sign() < 0 {
+			z = bigPi(prec)
+		}
+	case "factorial", "doublefactorial":
+		// Γ is not computed with big.Float, only the integers have a factorial here
+		if !x.IsInt() || x.IsInf() {
+			return nil, false
+		}
+		z = bigFactorial(name, x.Float)
+	default:
+		return nil, false
+	}
+	return BigFloat{z}, true
+}
+
+// bigMode evaluate literals and constants as BigFloat
+type bigMode struct {
+	prec uint
+}
+
+func (m bigMode) literal(n NumberExprNode) Value {
+	if n.Str == "" {
+		return BigFloat{new(big.Float).SetPrec(m.prec)}
+	}
+	f, _, err := big.ParseFloat(n.Str, 10, m.prec, big.ToNearestEven)
+	if err != nil {
+		return BigFloat{new(big.Float).SetPrec(m.prec).SetFloat64(n.Val)}
+	}
+	return BigFloat{f}
+}
+
+func (m bigMode) constant(n ConstExprNode) Value {
+	switch n.Name {
+	case "pi":
+		return BigFloat{bigPi(m.prec)}
+	case "e":
+		return BigFloat{bigExp(new(big.Float).SetPrec(m.prec).SetInt64(1))}
+	}
+	return BigFloat{new(big.Float).SetPrec(m.prec).SetFloat64(n.Val)}
+}
+
+// EvalBig parse s and evaluate the whole tree with big.Float at e.Precision bits,
+// including the literals, pi, e and the builtin functions.
+// a function or an operator without a big.Float version is ErrInexact instead of a float64 result
+func (e *Engine) EvalBig(s string, params map[string]*big.Float) (r *big.Float, err error) {
+	return e.evalBig(nil, s, params)
+}
+
+// EvalBigContext same as EvalBig, the evaluation stops as soon as ctx is done
+func (e *Engine) EvalBigContext(ctx context.Context, s string, params map[string]*big.Float) (r *big.Float, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return e.evalBig(ctx, s, params)
+}
+
+func (e *Engine) evalBig(ctx context.Context, s string, params map[string]*big.Float) (r *big.Float, err error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	prec := e.Precision
+	if prec == 0 {
+		prec = DefaultPrecision
+	}
+	values := make(map[string]Value, len(params))
+	for k, v := range params {
+		values[k] = BigFloat{v}
+	}
+	ev := e.newEvaluator(ctx, Integer(0))
+	ev.mode = bigMode{prec}
+	ev.strict = true
+	switch v := ev.eval(ar, values).(type) {
+	case BigFloat:
+		return v.Float, nil
+	case Bool:
+		return new(big.Float).SetPrec(prec).SetFloat64(resultFloat(v)), nil
+	default:
+		if _, ok := toFloat(v); !ok {
+			panic(&TypeError{Want: "number", Got: v.Kind()})
+		}
+		return toBig(v, prec), nil
+	}
+}
+
+// guardBits is the extra precision of the intermediate results of the big math functions
+const guardBits = 64
+
+// newBig returns a zero *big.Float of precision prec
+func newBig(prec uint) *big.Float {
+	return new(big.Float).SetPrec(prec)
+}
+
+// bigInt returns n as a *big.Float of precision prec
+func bigInt(n int64, prec uint) *big.Float {
+	return newBig(prec).SetInt64(n)
+}
+
+// bigPi π with Machin's formula: π = 16·atan(1/5) - 4·atan(1/239)
+func bigPi(prec uint) *big.Float {
+	wp := prec + guardBits
+	a := bigAtanInv(5, wp)
+	a.Mul(a, bigInt(16, wp))
+	b := bigAtanInv(239, wp)
+	b.Mul(b, bigInt(4, wp))
+	return newBig(prec).Sub(a, b)
+}
+
+// bigAtanInv atan(1/n) = Σ (-1)^k / ((2k+1)·n^(2k+1))
+func bigAtanInv(n int64, prec uint) *big.Float {
+	sum := newBig(prec)
+	pow := newBig(prec).Quo(bigInt(1, prec), bigInt(n, prec))
+	n2 := bigInt(n*n, prec)
+	term := newBig(prec)
+	for k := int64(0); ; k++ {
+		term.Quo(pow, bigInt(2*k+1, prec))
+		if negligible(term, sum, prec) {
+			return sum
+		}
+		if k%2 == 0 {
+			sum.Add(sum, term)
+		} else {
+			sum.Sub(sum, term)
+		}
+		pow.Quo(pow, n2)
+	}
+}
+
+// negligible reports whether adding term to sum does not change it at precision prec
+func negligible(term, sum *big.Float, prec uint) bool {
+	if term.Sign() == 0 {
+		return true
+	}
+	return sum.Sign() != 0 && term.MantExp(nil)-sum.MantExp(nil) < -int(prec)
+}
+
+// bigExp e^x, x is divided by 2^k until |x| < 1, the series result is squared k times
+func bigExp(x *big.Float) *big.Float {
+	prec := x.Prec()
+	if x.IsInf() {
+		if x.Sign() < 0 {
+			return newBig(prec)
+		}
+		return newBig(prec).SetInf(false)
+	}
+	// e^x is out of the exponent range of big.Float once |x| >= 2^31
+	if x.MantExp(nil) > 31 {
+		if x.Sign() < 0 {
+			return newBig(prec)
+		}
+		return newBig(prec).SetInf(false)
+	}
+	k := 0
+	if exp := x.MantExp(nil); exp > 0 {
+		k = exp
+	}
+	wp := prec + guardBits + uint(k)
+	r := newBig(wp).SetMantExp(x, -k)
+	sum := bigInt(1, wp)
+	term := bigInt(1, wp)
+	for n := int64(1); ; n++ {
+		term.Mul(term, r)
+		term.Quo(term, bigInt(n, wp))
+		if negligible(term, sum, wp) {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	for ; k > 0; k-- {
+		sum.Mul(sum, sum)
+	}
+	return newBig(prec).Set(sum)
+}
+
+// bigLog ln(x) = ln(m) + e·ln(2) with x = m·2^e and 0.5 <= m < 1,
+// ln(m) = 2·atanh((m-1)/(m+1)) converges fast on that range
+func bigLog(x *big.Float) *big.Float {
+	prec := x.Prec()
+	switch {
+	case x.Sign() < 0:
+		panic(errors.New("logarithm of a negative number is not a real number"))
+	case x.Sign() == 0:
+		return newBig(prec).SetInf(true)
+	case x.IsInf():
+		return newBig(prec).SetInf(false)
+	}
+	wp := prec + guardBits
+	m := newBig(wp)
+	e := x.MantExp(m)
+	one := bigInt(1, wp)
+	z := newBig(wp).Quo(newBig(wp).Sub(m, one), newBig(wp).Add(m, one))
+	r := bigAtanh(z)
+	if e != 0 {
+		ln2 := bigAtanh(newBig(wp).Quo(one, bigInt(3, wp)))
+		r.Add(r, ln2.Mul(ln2, bigInt(int64(e), wp)))
+	}
+	return newBig(prec).Set(r)
+}
+
+// bigAtanh 2·atanh(z) = 2·Σ z^(2k+1) / (2k+1), |z| should be small
+func bigAtanh(z *big.Float) *big.Float {
+	prec := z.Prec()
+	sum := newBig(prec).Set(z)
+	pow := newBig(prec).Set(z)
+	z2 := newBig(prec).Mul(z, z)
+	term := newBig(prec)
+	for k := int64(1); ; k++ {
+		pow.Mul(pow, z2)
+		term.Quo(pow, bigInt(2*k+1, prec))
+		if negligible(term, sum, prec) {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	return sum.Mul(sum, bigInt(2, prec))
+}
+
+// bigPow x^y, integer exponents are computed by squaring, the others with e^(y·ln(x))
+func bigPow(x, y *big.Float, prec uint) *big.Float {
+	if y.IsInt() && !y.IsInf() {
+		if n, acc := y.Int64(); acc == big.Exact {
+			return bigPowInt(x, n, prec)
+		}
+	}
+	switch x.Sign() {
+	case -1:
+		panic(errors.New("fractional power of a negative number is not a real number"))
+	case 0:
+		if y.Sign() < 0 {
+			return newBig(prec).SetInf(false)
+		}
+		return newBig(prec)
+	}
+	wp := prec + guardBits
+	l := bigLog(newBig(wp).Set(x))
+	l.Mul(l, y)
+	return newBig(prec).Set(bigExp(l))
+}
+
+// bigPowInt x^n by squaring, 0^-n is +Inf like math.Pow
+func bigPowInt(x *big.Float, n int64, prec uint) *big.Float {
+	wp := prec + guardBits
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	r := bigInt(1, wp)
+	b := newBig(wp).Set(x)
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			r.Mul(r, b)
+		}
+		if n > 1 {
+			b.Mul(b, b)
+		}
+	}
+	if neg {
+		r.Quo(bigInt(1, wp), r)
+	}
+	return newBig(prec).Set(r)
+}
+
+// bigCbrt cube root with Newton's method y = (2y + x/y²) / 3, starting from the float64 result
+func bigCbrt(x *big.Float) *big.Float {
+	prec := x.Prec()
+	if x.Sign() == 0 || x.IsInf() {
+		return newBig(prec).Set(x)
+	}
+	wp := prec + guardBits
+	m := newBig(wp)
+	e := x.MantExp(m)
+	// x = m·2^e with e a multiple of 3 so that the exponent of the guess is exact
+	for e%3 != 0 {
+		m.SetMantExp(m, 1)
+		e--
+	}
+	mf, _ := m.Float64()
+	y := newBig(wp).SetFloat64(math.Cbrt(mf))
+	y.SetMantExp(y, e/3)
+	xw := newBig(wp).Set(x)
+	three := bigInt(3, wp)
+	t := newBig(wp)
+	// every step doubles the correct bits of the 53 of the guess
+	for bits := uint(26); bits < wp; bits *= 2 {
+		t.Mul(y, y)
+		t.Quo(xw, t)
+		y.Add(y, y)
+		y.Add(y, t)
+		y.Quo(y, three)
+	}
+	return newBig(prec).Set(y)
+}
+
+// bigRound ceil, floor and round (half away from zero) of x
+func bigRound(name string, x *big.Float) *big.Float {
+	prec := x.Prec()
+	if x.IsInt() || x.IsInf() {
+		return newBig(prec).Set(x)
+	}
+	t := newBig(prec + guardBits).Set(x)
+	if name == "round" {
+		half := big.NewFloat(0.5)
+		if x.Sign() < 0 {
+			t.Sub(t, half)
+		} else {
+			t.Add(t, half)
+		}
+	}
+	i, _ := t.Int(nil)
+	switch {
+	case name == "ceil" && x.Sign() > 0:
+		i.Add(i, big.NewInt(1))
+	case name == "floor" && x.Sign() < 0:
+		i.Sub(i, big.NewInt(1))
+	}
+	return newBig(prec).SetInt(i)
+}
+
+// bigFactorial x! or x!! of an integer x, computed exactly and rounded to the precision of x
+func bigFactorial(name string, x *big.Float) *big.Float {
+	n, _ := x.Int64()
+	double := name == "doublefactorial"
+	switch {
+	case n < 0 && !(double && n == -1):
+		panic(fmt.Errorf("`%s` is not defined on %d", name, n))
+	case n > maxBigFactorial:
+		panic(fmt.Errorf("%w: `%s` of %d", ErrBigTooLarge, name, n))
+	}
+	r := big.NewInt(1)
+	if !double {
+		r.MulRange(2, n)
+	}
+	for ; double && n > 1; n -= 2 {
+		r.Mul(r, big.NewInt(n))
+	}
+	return newBig(x.Prec()).SetInt(r)
+}
+
+// bigSinCos sin(x) and cos(x), x is first reduced to [-π, π]
+func bigSinCos(x *big.Float) (*big.Float, *big.Float) {
+	prec := x.Prec()
+	if x.IsInf() {
+		panic(errors.New("trigonometric function of an infinite number"))
+	}
+	wp := prec + guardBits
+	if exp := x.MantExp(nil); exp > maxReduceBits {
+		panic(fmt.Errorf("%w: the argument of a trigonometric function has %d bits before the point", ErrBigTooLarge, exp))
+	} else if exp > 0 {
+		// removing the multiples of 2π costs exp bits
+		wp += uint(exp)
+	}
+	r := newBig(wp).Set(x)
+	tau := bigPi(wp)
+	tau.Mul(tau, bigInt(2, wp))
+	n := bigRound("round", newBig(wp).Quo(r, tau))
+	r.Sub(r, n.Mul(n, tau))
+
+	// term is r^k / k!, the even ones go to cos and the odd ones to sin with alternating signs
+	sin := newBig(wp)
+	cos := bigInt(1, wp)
+	term := bigInt(1, wp)
+	for k := int64(1); ; k++ {
+		term.Mul(term, r)
+		term.Quo(term, bigInt(k, wp))
+		if k > 1 && negligible(term, sin, wp) && negligible(term, cos, wp) ||
+			term.MantExp(nil) < -2*int(wp) {
+			break
+		}
+		switch k % 4 {
+		case 0:
+			cos.Add(cos, term)
+		case 1:
+			sin.Add(sin, term)
+		case 2:
+			cos.Sub(cos, term)
+		case 3:
+			sin.Sub(sin, term)
+		}
+	}
+	return newBig(prec).Set(sin), newBig(prec).Set(cos)
+}
+
+func bigSin(x *big.Float) *big.Float {
+	sin, _ := bigSinCos(x)
+	return sin
+}
+
+func bigCos(x *big.Float) *big.Float {
+	_, cos := bigSinCos(x)
+	return cos
+}
+
+// bigTrigRatio tan, cot, sec and csc from sin and cos, a zero divisor gives +Inf like float64
+func bigTrigRatio(name string, x *big.Float) *big.Float {
+	sin, cos := bigSinCos(x)
+	z := newBig(x.Prec())
+	switch name {
+	case "tan":
+		return bigQuo(z, sin, cos)
+	case "cot":
+		return bigQuo(z, cos, sin)
+	case "sec":
+		return bigQuo(z, bigInt(1, z.Prec()), cos)
+	default:
+		return bigQuo(z, bigInt(1, z.Prec()), sin)
+	}
+}
+
+func bigQuo(z, a, b *big.Float) *big.Float {
+	if b.Sign() == 0 {
+		return z.SetInf(false)
+	}
+	return z.Quo(a, b)
+}
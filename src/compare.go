@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"math"
+	"strings"
+)
+
+// compare evaluate a comparison: numbers are ordered by value across the numeric kinds,
+// quantities in compatible units and strings lexicographically.
+// == and != also compare booleans, null and lists, the other operators want ordered values.
+// a comparison of overlapping intervals is the indeterminate [0, 1]
+func (ev *evaluator) compare(op *Compare, a, b Value) Value {
+	if isQuantity(a) || isQuantity(b) {
+		l, r, _ := ev.sameUnit(op.name, a, b)
+		return ev.compare(op, l, r)
+	}
+	if isNaN(a) || isNaN(b) {
+		return Bool(op.name == "!=")
+	}
+	if c, ok := order(a, b); ok {
+		return Bool(op.test(c))
+	}
+	if n, ok := dispatch(a, b); ok {
+		if _, ok := n.(Interval); ok {
+			// overlapping intervals may compare either way, [0, 1] encloses both answers
+			return Interval{0, 1}
+		}
+	}
+	if !op.equality() {
+		got := a
+		if _, ok := order(a, a); ok {
+			got = b
+		}
+		panic(&TypeError{Op: op.name, Want: "ordered values", Got: got.Kind()})
+	}
+	return Bool(ev.equal(a, b) == (op.name == "=="))
+}
+
+// order returns the three-way comparison of two numbers or two strings, ok is false if they are not ordered
+func order(a, b Value) (c int, ok bool) {
+	if n, ok := dispatch(a, b); ok {
+		return n.cmp(a, b)
+	}
+	if x, y, ok := integers(a, b); ok {
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	x, ok1 := toFloat(a)
+	y, ok2 := toFloat(b)
+	if ok1 && ok2 {
+		return cmpFloat(x, y), true
+	}
+	if x, ok := a.(String); ok {
+		if y, ok := b.(String); ok {
+			return strings.Compare(string(x), string(y)), true
+		}
+	}
+	return 0, false
+}
+
+// equal compare the values order does not, lists are equal when all their items are
+func (ev *evaluator) equal(a, b Value) bool {
+	switch x := a.(type) {
+	case List:
+		y, ok := b.(List)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		eq := operators["=="].(*Compare)
+		for i := range x {
+			if ev.compare(eq, x[i], y[i]) != Bool(true) {
+				return false
+			}
+		}
+		return true
+	case Complex:
+		if rankOf(b) >= 0 {
+			return complex128(x) == toComplex(b)
+		}
+	}
+	if _, ok := b.(Complex); ok && rankOf(a) >= 0 {
+		return toComplex(a) == complex128(b.(Complex))
+	}
+	if isList(b) {
+		return false
+	}
+	return a == b
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func isNaN(v Value) bool {
+	f, ok := toFloat(v)
+	return ok && math.IsNaN(f)
+}
@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// maxComplexPow bounds the integer exponents computed by repeated multiplication, larger ones use cmplx.Pow
+const maxComplexPow = 1 << 10
+
+// Complex 复数，由 EvalComplex 产生
+type Complex complex128
+
+func (z Complex) Kind() Kind {
+	return ComplexKind
+}
+
+// String returns z as a+bi, e.g. 3+4i, 2-i or 1.5
+func (z Complex) String() string {
+	return complexText(complex128(z), "")
+}
+
+// LaTex returns z for a LaTeX formula, e.g. 3 + 4i
+func (z Complex) LaTex() string {
+	return complexText(complex128(z), " ")
+}
+
+// complexText format z, sep surrounds the sign between the real and the imaginary part
+func complexText(z complex128, sep string) string {
+	re, im := real(z), imag(z)
+	if im == 0 {
+		return Float64ToStr(re)
+	}
+	s := Float64ToStr(math.Abs(im))
+	if s == "1" {
+		s = ""
+	}
+	s += "i"
+	if re == 0 {
+		if im < 0 {
+			return "-" + s
+		}
+		return s
+	}
+	op := "+"
+	if im < 0 {
+		op = "-"
+	}
+	return Float64ToStr(re) + sep + op + sep + s
+}
+
+func (z Complex) rank() int {
+	return rankComplex
+}
+
+// float returns the real part, ok is false if z is not real
+func (z Complex) float() (float64, bool) {
+	return real(z), imag(z) == 0
+}
+
+// toComplex convert a number of a lower rank
+func toComplex(v Value) complex128 {
+	if z, ok := v.(Complex); ok {
+		return complex128(z)
+	}
+	f, _ := toFloat(v)
+	return complex(f, 0)
+}
+
+func (z Complex) binary(op string, a, b Value) (Value, bool) {
+	l, r := toComplex(a), toComplex(b)
+	switch op {
+	case "+":
+		return Complex(l + r), true
+	case "-":
+		return Complex(l - r), true
+	case "*":
+		return Complex(l * r), true
+	case "/":
+		if r == 0 {
+			panic(&DivisionByZeroError{Op: "/", Lhs: real(l), Rhs: 0})
+		}
+		return Complex(l / r), true
+	case "^":
+		return Complex(complexPow(l, r)), true
+	}
+	return nil, false
+}
+
+// complexPow computes the small integer powers by squaring so that i^2 is exactly -1
+func complexPow(x, y complex128) complex128 {
+	n := real(y)
+	if imag(y) != 0 || n != math.Trunc(n) || math.Abs(n) > maxComplexPow {
+		return cmplx.Pow(x, y)
+	}
+	k := int(math.Abs(n))
+	r := complex(1, 0)
+	for ; k > 0; k >>= 1 {
+		if k&1 == 1 {
+			r *= x
+		}
+		x *= x
+	}
+	if n < 0 {
+		return 1 / r
+	}
+	return r
+}
+
+// cmp complex numbers are only ordered on the real line
+func (z Complex) cmp(a, b Value) (int, bool) {
+	l, r := toComplex(a), toComplex(b)
+	if imag(l) != 0 || imag(r) != 0 {
+		return 0, false
+	}
+	switch {
+	case real(l) < real(r):
+		return -1, true
+	case real(l) > real(r):
+		return 1, true
+	}
+	return 0, true
+}
+
+func (z Complex) call(name string) (Value, bool) {
+	x := complex128(z)
+	switch name {
+	case "abs":
+		return Complex(complex(cmplx.Abs(x), 0)), true
+	case "re":
+		return Complex(complex(real(x), 0)), true
+	case "im":
+		return Complex(complex(imag(x), 0)), true
+	case "arg":
+		return Complex(complex(cmplx.Phase(x), 0)), true
+	case "conj":
+		return Complex(cmplx.Conj(x)), true
+	case "ceil":
+		return Complex(complex(math.Ceil(real(x)), math.Ceil(imag(x)))), true
+	case "floor":
+		return Complex(complex(math.Floor(real(x)), math.Floor(imag(x)))), true
+	case "round":
+		return Complex(complex(math.Round(real(x)), math.Round(imag(x)))), true
+	case "sqrt":
+		return Complex(cmplx.Sqrt(x)), true
+	case "cbrt":
+		// the real cube root of a real number, the principal root otherwise
+		if imag(x) == 0 {
+			return Complex(complex(math.Cbrt(real(x)), 0)), true
+		}
+		return Complex(cmplx.Pow(x, 1.0/3)), true
+	case "ln":
+		return Complex(cmplx.Log(x)), true
+	case "lg":
+		return Complex(cmplx.Log10(x)), true
+	case "rad":
+		return Complex(x / 180 * math.Pi), true
+	case "sin":
+		return Complex(cmplx.Sin(x)), true
+	case "cos":
+		return Complex(cmplx.Cos(x)), true
+	case "tan":
+		return Complex(cmplx.Tan(x)), true
+	case "cot":
+		return Complex(cmplx.Cot(x)), true
+	case "sec":
+		return Complex(1 / cmplx.Cos(x)), true
+	case "csc":
+		return Complex(1 / cmplx.Sin(x)), true
+	}
+	return nil, false
+}
+
+// complexMode evaluate literals and constants as Complex, the constant i is the imaginary unit
+type complexMode struct{}
+
+func (complexMode) literal(n NumberExprNode) Value {
+	return Complex(complex(n.Val, 0))
+}
+
+func (complexMode) constant(n ConstExprNode) Value {
+	if n.Name == "i" {
+		return Complex(1i)
+	}
+	return Complex(complex(n.Val, 0))
+}
+
+// EvalComplex parse s and evaluate it with complex numbers,
+// i is the imaginary unit and sqrt(-1), ln(-2) or e^(i*pi) have complex results instead of NaN
+func (e *Engine) EvalComplex(s string, params map[string]complex128) (z complex128, err error) {
+	ar, err := e.parseExprWith(s, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	values := make(map[string]Value, len(params))
+	for k, v := range params {
+		values[k] = Complex(v)
+	}
+	ev := e.newEvaluator(nil, Integer(0))
+	ev.mode = complexMode{}
+	v := ev.eval(ar, values)
+	if _, ok := v.(Bool); ok {
+		return complex(resultFloat(v), 0), nil
+	}
+	if _, ok := v.(Complex); !ok {
+		if _, ok := toFloat(v); !ok {
+			panic(&TypeError{Want: "number", Got: v.Kind()})
+		}
+	}
+	return toComplex(v), nil
+}
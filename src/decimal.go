@@ -0,0 +1,302 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// RoundingMode 十进制舍入方式
+type RoundingMode int
+
+const (
+	// RoundHalfEven rounds to the nearest, ties to the even neighbour (banker's rounding)
+	RoundHalfEven RoundingMode = iota
+	// RoundHalfUp rounds to the nearest, ties away from zero
+	RoundHalfUp
+	// RoundHalfDown rounds to the nearest, ties toward zero
+	RoundHalfDown
+	// RoundDown rounds toward zero
+	RoundDown
+	// RoundUp rounds away from zero
+	RoundUp
+	// RoundCeiling rounds toward +Inf
+	RoundCeiling
+	// RoundFloor rounds toward -Inf
+	RoundFloor
+)
+
+// DecimalContext 十进制定点运算的精度与舍入方式
+type DecimalContext struct {
+	// Scale is the number of digits kept after the decimal point by every operation
+	Scale int
+	// Rounding is applied when a result has more digits than Scale, and by round
+	Rounding RoundingMode
+}
+
+// DefaultDecimal is the decimal context of a new Engine
+var DefaultDecimal = DecimalContext{
+	Scale:    2,
+	Rounding: RoundHalfEven,
+}
+
+// Decimal 十进制定点数，由 EvalDecimal 产生
+// the value is unscaled / 10^scale
+type Decimal struct {
+	unscaled *big.Int
+	scale    int
+	// ctx is set by EvalDecimal, the operations round their result with it
+	ctx DecimalContext
+}
+
+// NewDecimal returns unscaled / 10^scale
+func NewDecimal(unscaled int64, scale int) Decimal {
+	if scale < 0 {
+		panic(errors.New("NewDecimal scale should not be negative"))
+	}
+	return Decimal{unscaled: big.NewInt(unscaled), scale: scale}
+}
+
+// ParseDecimal read a decimal number such as "-12.50" or "1e-3", the digits are kept exactly
+func ParseDecimal(s string) (Decimal, error) {
+	mant, exp := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return Decimal{}, fmt.Errorf("ParseDecimal: invalid decimal %q", s)
+		}
+		mant, exp = s[:i], e
+	}
+	scale := 0
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		scale = len(mant) - i - 1
+		mant = mant[:i] + mant[i+1:]
+	}
+	unscaled, ok := new(big.Int).SetString(mant, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("ParseDecimal: invalid decimal %q", s)
+	}
+	scale -= exp
+	if scale < 0 {
+		unscaled.Mul(unscaled, pow10(-scale))
+		scale = 0
+	}
+	return Decimal{unscaled: unscaled, scale: scale}, nil
+}
+
+// pow10 returns 10^n
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func (x Decimal) Kind() Kind {
+	return DecimalKind
+}
+
+// Unscaled returns the digits of x without the decimal point
+func (x Decimal) Unscaled() *big.Int {
+	if x.unscaled == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(x.unscaled)
+}
+
+// Scale returns the number of digits after the decimal point
+func (x Decimal) Scale() int {
+	return x.scale
+}
+
+// Rat returns x as an exact fraction
+func (x Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(x.Unscaled(), pow10(x.scale))
+}
+
+// String returns x with exactly Scale digits after the decimal point, e.g. 0.30
+func (x Decimal) String() string {
+	unscaled := x.Unscaled()
+	digits := new(big.Int).Abs(unscaled).String()
+	sign := ""
+	if unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	if x.scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= x.scale {
+		digits = strings.Repeat("0", x.scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-x.scale] + "." + digits[len(digits)-x.scale:]
+}
+
+func (x Decimal) rank() int {
+	return rankDecimal
+}
+
+func (x Decimal) float() (float64, bool) {
+	f, _ := x.Rat().Float64()
+	return f, true
+}
+
+// round returns r with the scale and rounding mode of c
+func (c DecimalContext) round(r *big.Rat) Decimal {
+	return c.roundTo(r, c.Scale, c.Rounding)
+}
+
+func (c DecimalContext) roundTo(r *big.Rat, scale int, mode RoundingMode) Decimal {
+	if scale < 0 {
+		// rounding to tens, hundreds... keeps no digit after the decimal point
+		p := pow10(-scale)
+		n := roundRat(new(big.Rat).Quo(r, new(big.Rat).SetInt(p)), 0, mode)
+		return Decimal{unscaled: n.Mul(n, p), ctx: c}
+	}
+	return Decimal{unscaled: roundRat(r, scale, mode), scale: scale, ctx: c}
+}
+
+// roundRat returns r·10^scale rounded to an integer with mode
+func roundRat(r *big.Rat, scale int, mode RoundingMode) *big.Int {
+	q := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(scale)))
+	n, rem := new(big.Int).QuoRem(q.Num(), q.Denom(), new(big.Int))
+	if rem.Sign() == 0 {
+		return n
+	}
+	sign := int64(q.Sign())
+	// half compares the discarded fraction to 1/2
+	rem.Abs(rem)
+	half := rem.Lsh(rem, 1).Cmp(q.Denom())
+	var away bool
+	switch mode {
+	case RoundHalfEven:
+		away = half > 0 || half == 0 && n.Bit(0) == 1
+	case RoundHalfUp:
+		away = half >= 0
+	case RoundHalfDown:
+		away = half > 0
+	case RoundUp:
+		away = true
+	case RoundCeiling:
+		away = sign > 0
+	case RoundFloor:
+		away = sign < 0
+	}
+	if away {
+		n.Add(n, big.NewInt(sign))
+	}
+	return n
+}
+
+// decimalContext returns the context of the decimal operand of an operation
+func decimalContext(a, b Value) DecimalContext {
+	if x, ok := a.(Decimal); ok {
+		return x.ctx
+	}
+	return b.(Decimal).ctx
+}
+
+func (x Decimal) binary(op string, a, b Value) (Value, bool) {
+	ctx := decimalContext(a, b)
+	l, r := toRat(a), toRat(b)
+	switch op {
+	case "+":
+		return ctx.round(l.Add(l, r)), true
+	case "-":
+		return ctx.round(l.Sub(l, r)), true
+	case "*":
+		return ctx.round(l.Mul(l, r)), true
+	case "/":
+		if r.Sign() == 0 {
+			lf, _ := l.Float64()
+			panic(&DivisionByZeroError{Op: "/", Lhs: lf, Rhs: 0})
+		}
+		return ctx.round(l.Quo(l, r)), true
+	}
+	// % and the integer powers are exact on rationals
+	v, ok := Rational{l}.binary(op, Rational{l}, Rational{r})
+	if !ok {
+		return nil, false
+	}
+	return ctx.round(v.(Rational).Rat), true
+}
+
+func (x Decimal) cmp(a, b Value) (int, bool) {
+	return toRat(a).Cmp(toRat(b)), true
+}
+
+func (x Decimal) call(name string) (Value, bool) {
+	switch name {
+	case "abs":
+		return Decimal{unscaled: new(big.Int).Abs(x.Unscaled()), scale: x.scale, ctx: x.ctx}, true
+	case "ceil":
+		return x.ctx.roundTo(x.Rat(), 0, RoundCeiling), true
+	case "floor":
+		return x.ctx.roundTo(x.Rat(), 0, RoundFloor), true
+	case "round":
+		return x.ctx.roundTo(x.Rat(), 0, x.ctx.Rounding), true
+	}
+	return nil, false
+}
+
+// decimalMode evaluate literals and constants as Decimal
+type decimalMode struct {
+	ctx DecimalContext
+}
+
+func (m decimalMode) literal(n NumberExprNode) Value {
+	d, err := ParseDecimal(n.Str)
+	if err != nil {
+		return m.ctx.round(new(big.Rat).SetFloat64(n.Val))
+	}
+	d.ctx = m.ctx
+	return d
+}
+
+// constant pi and e stay float64 instead of being cut to Scale digits,
+// the other constants are read from their shortest decimal form
+func (m decimalMode) constant(n ConstExprNode) Value {
+	if n.Name == "pi" || n.Name == "e" || math.IsInf(n.Val, 0) || math.IsNaN(n.Val) {
+		return Number(n.Val)
+	}
+	d, _ := ParseDecimal(strconv.FormatFloat(n.Val, 'g', -1, 64))
+	d.ctx = m.ctx
+	return d
+}
+
+// EvalDecimal parse s and evaluate it with decimal fixed-point arithmetic:
+// every operator rounds its result to e.Decimal.Scale digits with e.Decimal.Rounding,
+// round, ceil and floor are exact and round(x, digits) uses e.Decimal.Rounding.
+// the other functions and the constants pi and e fall back to float64,
+// the result is always rounded to e.Decimal.Scale
+func (e *Engine) EvalDecimal(s string, params map[string]Decimal) (d Decimal, err error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return Decimal{}, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	ctx := e.Decimal
+	values := make(map[string]Value, len(params))
+	for k, v := range params {
+		v.ctx = ctx
+		values[k] = v
+	}
+	ev := e.newEvaluator(nil, Integer(0))
+	ev.mode = decimalMode{ctx}
+	v := ev.eval(ar, values)
+	switch v := v.(type) {
+	case Decimal, Integer, Rational:
+		return ctx.round(toRat(v)), nil
+	case Bool:
+		return ctx.round(new(big.Rat).SetFloat64(resultFloat(v))), nil
+	}
+	f, ok := toFloat(v)
+	if !ok || math.IsInf(f, 0) || math.IsNaN(f) {
+		panic(&TypeError{Want: "a finite number", Got: v.Kind()})
+	}
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+	return ctx.round(r), nil
+}
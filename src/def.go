@@ -14,17 +14,21 @@ const (
 
 type DefineFunc struct {
 	argc     int
-	fun      func(params map[string]float64, args ...ExprNode) float64
-	funLaTex func(args ...ExprNode) string
+	fun      func(ev *evaluator, params map[string]Value, args ...ExprNode) Value
+	funLaTex func(e *Engine, args ...ExprNode) string
+	// compile builds the closure used by Program, nil falls back to calling fun
+	compile compileFunc
 }
 
-var defaultLaTexFunc = func(args ...ExprNode) string {
+var defaultLaTexFunc = func(e *Engine, args ...ExprNode) string {
 	return ""
 }
 
 // TrigonometricMode enum "RadianMode", "AngleMode"
+// only used by the default engine, see Engine.TrigonometricMode
 var TrigonometricMode = RadianMode
 
+// defConst, defConstLaTex and defFunc are the builtin tables copied into every new Engine
 var defConst = map[string]float64{
 	"pi":    math.Pi,
 	"e":     math.E,
@@ -41,194 +45,379 @@ var defFunc map[string]DefineFunc
 
 func init() {
 	defFunc = map[string]DefineFunc{
-		"sin": {1, defSin, defSinLaTex},
-		"cos": {1, defCos, defCosLaTex},
-		"tan": {1, defTan, defTanLaTex},
-		"cot": {1, defCot, defCotLaTex},
-		"sec": {1, defSec, defSecLaTex},
-		"csc": {1, defCsc, defCscLaTex},
-
-		"abs":   {1, defAbs, defAbsLaTex},
-		"ceil":  {1, defCeil, defaultLaTexFunc},
-		"floor": {1, defFloor, defaultLaTexFunc},
-		"round": {1, defRound, defaultLaTexFunc},
-		"sqrt":  {1, defSqrt, defSqrtLaTex},
-		"cbrt":  {1, defCbrt, defaultLaTexFunc},
-
-		"noerr": {1, defNoerr, defaultLaTexFunc},
-
-		"max": {-1, defMax, defaultLaTexFunc},
-		"min": {-1, defMin, defaultLaTexFunc},
-
-		"sum": {-1, defSum, defSumLaTex},
+		"sin": {1, defSin, defSinLaTex, compileTrig(math.Sin)},
+		"cos": {1, defCos, defCosLaTex, compileTrig(math.Cos)},
+		"tan": {1, defTan, defTanLaTex, compileTrig(math.Tan)},
+		"cot": {1, defCot, defCotLaTex, compileTrig(cot)},
+		"sec": {1, defSec, defSecLaTex, compileTrig(sec)},
+		"csc": {1, defCsc, defCscLaTex, compileTrig(csc)},
+
+		"abs":   {1, defAbs, defAbsLaTex, compileMath(math.Abs)},
+		"ceil":  {1, defCeil, defaultLaTexFunc, compileMath(math.Ceil)},
+		"floor": {1, defFloor, defaultLaTexFunc, compileMath(math.Floor)},
+		"round": {-1, defRound, defaultLaTexFunc, compileRound},
+		"sqrt":  {1, defSqrt, defSqrtLaTex, compileMath(math.Sqrt)},
+		"cbrt":  {1, defCbrt, defaultLaTexFunc, compileMath(math.Cbrt)},
+
+		// 复数函数，实数上 re(x) = x, im(x) = 0
+		"re":   {1, defRe, defaultLaTexFunc, compileMath(re)},
+		"im":   {1, defIm, defaultLaTexFunc, compileMath(im)},
+		"arg":  {1, defArg, defaultLaTexFunc, compileMath(arg)},
+		"conj": {1, defConj, defConjLaTex, compileMath(re)},
+
+		"noerr": {1, defNoerr, defaultLaTexFunc, compileNoerr},
+
+		// 条件表达式，只求值选中的分支，cond ? a : b 解析为 if(cond, a, b)
+		"if": {3, defIf, defIfLaTex, compileIf},
+
+		"max": {-1, defMax, defaultLaTexFunc, compileFold(math.Max)},
+		"min": {-1, defMin, defaultLaTexFunc, compileFold(math.Min)},
+
+		"sum": {-1, defSum, defSumLaTex, compileSum},
+
+		// 向量与矩阵函数，结果为列表的函数不能编译
+		"dot":       {2, defDot, defDotLaTex, nil},
+		"cross":     {2, defCross, defCrossLaTex, nil},
+		"norm":      {1, defNorm, defNormLaTex, nil},
+		"det":       {1, defDet, defDetLaTex, nil},
+		"inv":       {1, defInv, defInvLaTex, nil},
+		"transpose": {1, defTranspose, defTransposeLaTex, nil},
+
+		// 逻辑非，!x 与 not x 解析为 not(x)
+		"not": {1, defNot, defNotLaTex, compileMath(logicalNot)},
+
+		// 后缀操作符 x!、x!! 与 x%
+		"factorial":       {1, defFactorial, defFactorialLaTex, compileMath(factorial)},
+		"doublefactorial": {1, defDoubleFactorial, defDoubleFactorialLaTex, compileMath(doubleFactorial)},
+		"percent":         {1, defPercent, defPercentLaTex, compileMath(percent)},
+
+		// 单位换算
+		"to": {2, defTo, defToLaTex, nil},
 
 		// 对数函数
-		"log": {2, defLog, defLogLaTex},
-		"lg":  {1, defLg, defLgLaTex},
-		"ln":  {1, defLn, defLnLaTex},
+		"log": {2, defLog, defLogLaTex, compileLog},
+		"lg":  {1, defLg, defLgLaTex, compileMath(math.Log10)},
+		"ln":  {1, defLn, defLnLaTex, compileMath(ln)},
 	}
+	std = NewEngine()
 }
 
 // sin(pi/2) = 1
 
-func defSin(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Sin(expr2Radian(expr[0], params))
+func defSin(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.trig("sin", math.Sin, expr[0], params)
 }
 
-func defSinLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("sin(%s)", ExprASTLaTex(args[0]))
+func defSinLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("sin(%s)", e.ExprASTLaTex(args[0]))
 }
 
 // cos(0) = 1
 
-func defCos(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Cos(expr2Radian(expr[0], params))
+func defCos(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.trig("cos", math.Cos, expr[0], params)
 }
 
-func defCosLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("cos(%s)", ExprASTLaTex(args[0]))
+func defCosLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("cos(%s)", e.ExprASTLaTex(args[0]))
 }
 
 // tan(pi/4) = 1
 
-func defTan(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Tan(expr2Radian(expr[0], params))
+func defTan(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.trig("tan", math.Tan, expr[0], params)
 }
 
-func defTanLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("tan(%s)", ExprASTLaTex(args[0]))
+func defTanLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("tan(%s)", e.ExprASTLaTex(args[0]))
 }
 
 // cot(pi/4) = 1
 
-func defCot(params map[string]float64, expr ...ExprNode) float64 {
-	return 1 / defTan(params, expr...)
+func defCot(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.trig("cot", cot, expr[0], params)
 }
 
-func defCotLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("cot(%s)", ExprASTLaTex(args[0]))
+func defCotLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("cot(%s)", e.ExprASTLaTex(args[0]))
 }
 
 // sec(0) = 1
 
-func defSec(params map[string]float64, expr ...ExprNode) float64 {
-	return 1 / defCos(params, expr...)
+func defSec(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.trig("sec", sec, expr[0], params)
 }
 
-func defSecLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("sec(%s)", ExprASTLaTex(args[0]))
+func defSecLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("sec(%s)", e.ExprASTLaTex(args[0]))
 }
 
 // csc(pi/2) = 1
 
-func defCsc(params map[string]float64, expr ...ExprNode) float64 {
-	return 1 / defSin(params, expr...)
+func defCsc(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.trig("csc", csc, expr[0], params)
 }
 
-func defCscLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("csc(%s)", ExprASTLaTex(args[0]))
+func defCscLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("csc(%s)", e.ExprASTLaTex(args[0]))
 }
 
 // abs(-2) = 2
 
-func defAbs(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Abs(ExprASTResult(expr[0], params))
+func defAbs(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	if n, ok := v.(Integer); ok && n != math.MinInt64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	return ev.apply("abs", math.Abs, v, expr[0])
 }
 
-func defAbsLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("|%s|", ExprASTLaTex(args[0]))
+func defAbsLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("|%s|", e.ExprASTLaTex(args[0]))
 }
 
 // ceil(4.2) = ceil(4.8) = 5
 
-func defCeil(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Ceil(ExprASTResult(expr[0], params))
+func defCeil(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	if n, ok := v.(Integer); ok {
+		return n
+	}
+	return ev.apply("ceil", math.Ceil, v, expr[0])
 }
 
 // floor(4.2) = floor(4.8) = 4
 
-func defFloor(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Floor(ExprASTResult(expr[0], params))
+func defFloor(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	if n, ok := v.(Integer); ok {
+		return n
+	}
+	return ev.apply("floor", math.Floor, v, expr[0])
 }
 
 // round(4.2) = 4
 // round(4.6) = 5
+// round(3.14159, 2) = 3.14
+// round(1234, -2) = 1200
 
-func defRound(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Round(ExprASTResult(expr[0], params))
+func defRound(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	if len(expr) == 0 || len(expr) > 2 {
+		panic(roundArity(len(expr)))
+	}
+	v := ev.eval(expr[0], params)
+	if len(expr) == 2 {
+		return ev.roundTo(v, ev.digits(expr[1], params), expr[0])
+	}
+	if n, ok := v.(Integer); ok {
+		return n
+	}
+	return ev.apply("round", math.Round, v, expr[0])
+}
+
+func roundArity(n int) *ArityError {
+	if n == 0 {
+		return &ArityError{Name: "round", Want: 1, Got: n, AtLeast: true}
+	}
+	return &ArityError{Name: "round", Want: 2, Got: n}
+}
+
+// digits evaluate the number of digits of round, it must be an integer
+func (ev *evaluator) digits(expr ExprNode, params map[string]Value) int {
+	v := ev.eval(expr, params)
+	f, ok := toFloat(v)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+		panic(&TypeError{Span: expr.Pos(), Op: "round", Want: "an integer number of digits", Got: v.Kind()})
+	}
+	return int(f)
+}
+
+// roundTo round v to d digits after the decimal point, before it when d is negative.
+// decimals use the rounding mode of the engine, the other kinds scale v by 10^d around round
+func (ev *evaluator) roundTo(v Value, d int, expr ExprNode) Value {
+	switch x := v.(type) {
+	case Integer:
+		if d >= 0 {
+			return x
+		}
+	case Number:
+		return Number(roundFloat(float64(x), float64(d)))
+	case Decimal:
+		return x.ctx.roundTo(x.Rat(), d, x.ctx.Rounding)
+	}
+	mul, div := operators["*"], operators["/"]
+	if d < 0 {
+		mul, div, d = div, mul, -d
+	}
+	p := ev.applyOperator(operators["^"], Integer(10), Integer(d))
+	return ev.applyOperator(div, ev.apply("round", math.Round, ev.applyOperator(mul, v, p), expr), p)
 }
 
 // sqrt(4) = 2
 // sqrt(4) = abs(sqrt(4))
 // returns only the absolute value of the result
 
-func defSqrt(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Sqrt(ExprASTResult(expr[0], params))
+func defSqrt(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("sqrt", math.Sqrt, expr[0], params)
 }
 
-func defSqrtLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("\\sqrt{%s}", ExprASTLaTex(args[0]))
+func defSqrtLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\sqrt{%s}", e.ExprASTLaTex(args[0]))
 }
 
 // cbrt(27) = 3
 
-func defCbrt(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Cbrt(ExprASTResult(expr[0], params))
+func defCbrt(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("cbrt", math.Cbrt, expr[0], params)
+}
+
+// re(3) = 3
+// re(3+4i) = 3 in EvalComplex
+
+func defRe(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("re", re, expr[0], params)
+}
+
+// im(3) = 0
+// im(3+4i) = 4 in EvalComplex
+
+func defIm(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("im", im, expr[0], params)
+}
+
+// arg(2) = 0
+// arg(-2) = pi
+// arg(i) = pi/2 in EvalComplex
+
+func defArg(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("arg", arg, expr[0], params)
+}
+
+// conj(3+4i) = 3-4i in EvalComplex
+
+func defConj(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("conj", re, expr[0], params)
+}
+
+func defConjLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\overline{%s}", e.ExprASTLaTex(args[0]))
+}
+
+// not(0) = true
+
+func defNot(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return Bool(!truth("not", ev.eval(expr[0], params)))
+}
+
+func defNotLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\neg %s", e.ExprASTLaTex(args[0]))
+}
+
+// factorial(5) = 5! = 120
+// factorial(0.5) = Γ(1.5)
+
+func defFactorial(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	if n, ok := v.(Integer); ok && n >= 0 && n <= maxIntFactorial {
+		r := Integer(1)
+		for i := Integer(2); i <= n; i++ {
+			r *= i
+		}
+		return r
+	}
+	return ev.apply("factorial", factorial, v, expr[0])
+}
+
+func defFactorialLaTex(e *Engine, args ...ExprNode) string {
+	return postfixLaTex(e, args[0], "!")
+}
+
+// doublefactorial(7) = 7!! = 7 * 5 * 3 * 1 = 105
+
+func defDoubleFactorial(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("doublefactorial", doubleFactorial, expr[0], params)
+}
+
+func defDoubleFactorialLaTex(e *Engine, args ...ExprNode) string {
+	return postfixLaTex(e, args[0], "!!")
+}
+
+// percent(15) = 15% = 0.15
+
+func defPercent(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.op("/", ev.eval(expr[0], params), Integer(100))
+}
+
+func defPercentLaTex(e *Engine, args ...ExprNode) string {
+	return postfixLaTex(e, args[0], "\\%")
+}
+
+// postfixLaTex render x followed by the postfix operator op, x is in parentheses unless it is a single term
+func postfixLaTex(e *Engine, x ExprNode, op string) string {
+	switch x.(type) {
+	case NumberExprNode, ConstExprNode, VariableExprNode, FunCallerExprNode:
+		return e.ExprASTLaTex(x) + op
+	}
+	return fmt.Sprintf("\\left(%s\\right)%s", e.ExprASTLaTex(x), op)
 }
 
 // max(2) = 2
 // max(2, 3) = 3
 // max(2, 3, 1) = 3
 
-func defMax(params map[string]float64, expr ...ExprNode) float64 {
+func defMax(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
 	if len(expr) == 0 {
-		panic(errors.New("calling function `max` must have at least one parameter."))
+		panic(&ArityError{Name: "max", Want: 1, Got: len(expr), AtLeast: true})
 	}
-	if len(expr) == 1 {
-		return ExprASTResult(expr[0], params)
-	}
-	maxV := ExprASTResult(expr[0], params)
-	for i := 1; i < len(expr); i++ {
-		v := ExprASTResult(expr[i], params)
-		maxV = math.Max(maxV, v)
-	}
-	return maxV
+	return fold(ev, params, "max", math.Max, expr...)
 }
 
 // min(2) = 2
 // min(2, 3) = 2
 // min(2, 3, 1) = 1
-func defMin(params map[string]float64, expr ...ExprNode) float64 {
+func defMin(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
 	if len(expr) == 0 {
-		panic(errors.New("calling function `min` must have at least one parameter."))
-	}
-	if len(expr) == 1 {
-		return ExprASTResult(expr[0], params)
+		panic(&ArityError{Name: "min", Want: 1, Got: len(expr), AtLeast: true})
 	}
-	maxV := ExprASTResult(expr[0], params)
-	for i := 1; i < len(expr); i++ {
-		v := ExprASTResult(expr[i], params)
-		maxV = math.Min(maxV, v)
-	}
-	return maxV
+	return fold(ev, params, "min", math.Min, expr...)
 }
 
 // noerr(1/0) = 0
 // noerr(2.5/(1-1)) = 0
-func defNoerr(params map[string]float64, expr ...ExprNode) (r float64) {
+func defNoerr(ev *evaluator, params map[string]Value, expr ...ExprNode) (r Value) {
 	defer func() {
-		if e := recover(); e != nil {
-			r = 0
+		if rec := recover(); rec != nil {
+			if aborted(rec) {
+				panic(rec)
+			}
+			r = Number(0)
 		}
 	}()
-	return ExprASTResult(expr[0], params)
+	return ev.eval(expr[0], params)
+}
+
+// if(1 > 0, 2, 1/0) = 2
+
+func defIf(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	if truth("if", ev.eval(expr[0], params)) {
+		return ev.eval(expr[1], params)
+	}
+	return ev.eval(expr[2], params)
+}
+
+func defIfLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\begin{cases}%s & \\text{if } %s \\\\ %s & \\text{otherwise}\\end{cases}",
+		e.ExprASTLaTex(args[1]), e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[2]))
 }
 
 // sum(0) = 1
 
-func defSum(params map[string]float64, expr ...ExprNode) float64 {
+func defSum(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
 	if len(expr) < 2 {
-		panic(errors.New("calling function `sum` must have at least two parameter."))
+		panic(&ArityError{Name: "sum", Want: 2, Got: len(expr), AtLeast: true})
 	}
 
 	name := reflect.TypeOf(expr[1]).Name()
@@ -240,68 +429,124 @@ func defSum(params map[string]float64, expr ...ExprNode) float64 {
 		sumV := 0.0
 		start := expr[0].(NumberExprNode)
 		end := expr[1].(NumberExprNode)
+		ev.iterate(loopCount(start.Val, end.Val))
 		for i := start.Val; i <= end.Val; i++ {
+			ev.step()
 			sumV = sumV + i
 		}
-		return sumV
+		return Number(sumV)
 	}
-	sumV := 0.0
+	var sumV Value = Integer(0)
 	start := expr[0].(NumberExprNode)
 	end := expr[1].(NumberExprNode)
+	ev.iterate(loopCount(math.Trunc(start.Val), math.Trunc(end.Val)))
+	// the iteration variable lives in a private scope, the caller's params are never written
+	scope := valueScope(params)
+	plus := operators["+"]
 	for i := int(start.Val); i <= int(end.Val); i++ {
-		params["#i"] = float64(i)
-		v := ExprASTResult(expr[2], params)
-		sumV = sumV + v
+		ev.step()
+		scope["#i"] = Integer(i)
+		v := ev.eval(expr[2], scope)
+		sumV = ev.applyOperator(plus, sumV, v)
 	}
-	delete(params, "#i")
 	return sumV
 }
 
-func defSumLaTex(args ...ExprNode) string {
+// privateScope copy params into a new map that can hold iteration variables
+func privateScope(params map[string]float64) map[string]float64 {
+	scope := make(map[string]float64, len(params)+1)
+	for k, v := range params {
+		scope[k] = v
+	}
+	return scope
+}
+
+// valueScope same as privateScope for the values of an evaluation
+func valueScope(params map[string]Value) map[string]Value {
+	scope := make(map[string]Value, len(params)+1)
+	for k, v := range params {
+		scope[k] = v
+	}
+	return scope
+}
+
+// fold evaluate the arguments and keep the one selected by f, e.g. max and min.
+// the numeric kinds may compute name themselves, the others are compared
+func fold(ev *evaluator, params map[string]Value, name string, f func(a, b float64) float64, expr ...ExprNode) Value {
+	r := ev.eval(expr[0], params)
+	for _, arg := range expr[1:] {
+		v := ev.eval(arg, params)
+		if n, ok := dispatch(r, v); ok {
+			if m, ok := n.binary(name, r, v); ok {
+				r = m
+				continue
+			}
+			c, ok := n.cmp(r, v)
+			if !ok {
+				panic(&TypeError{Span: arg.Pos(), Want: "an ordered number", Got: n.Kind()})
+			}
+			// f tells whether the greater or the smaller one is kept
+			if c != 0 && (c < 0) == (f(0, 1) == 1) {
+				r = v
+			}
+			continue
+		}
+		rf, vf := numberOf(r, expr[0]), numberOf(v, arg)
+		if m := f(rf, vf); m != rf && !math.IsNaN(rf) {
+			r = v
+		}
+	}
+	return r
+}
+
+func defSumLaTex(e *Engine, args ...ExprNode) string {
 	if len(args) < 2 {
-		panic(errors.New("calling function `sum` must have at least two parameter."))
+		panic(&ArityError{Name: "sum", Want: 2, Got: len(args), AtLeast: true})
 	}
 
 	if len(args) == 2 {
-		return fmt.Sprintf("\\sum_{i=%s}^{%s} k", ExprASTLaTex(args[0]), ExprASTLaTex(args[1]))
+		return fmt.Sprintf("\\sum_{i=%s}^{%s} k", e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[1]))
 	}
 
-	return fmt.Sprintf("\\sum_{i=%s}^{%s} %s", ExprASTLaTex(args[0]), ExprASTLaTex(args[1]), ExprASTLaTex(args[2]))
+	return fmt.Sprintf("\\sum_{i=%s}^{%s} %s", e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[1]), e.ExprASTLaTex(args[2]))
 }
 
 // log
-func defLog(params map[string]float64, expr ...ExprNode) float64 {
+func defLog(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
 	if len(expr) != 2 {
-		panic(errors.New("calling function `log` must have two parameter."))
+		panic(&ArityError{Name: "log", Want: 2, Got: len(expr)})
 	}
 
-	a := ExprASTResult(expr[0], params)
-	b := ExprASTResult(expr[1], params)
-	return math.Log10(b) / math.Log10(a)
+	a := ev.eval(expr[0], params)
+	b := ev.eval(expr[1], params)
+	if _, ok := dispatch(a, b); ok {
+		return ev.applyOperator(operators["/"], ev.apply("ln", ln, b, expr[1]), ev.apply("ln", ln, a, expr[0]))
+	}
+	return Number(math.Log10(numberOf(b, expr[1])) / math.Log10(numberOf(a, expr[0])))
 }
 
-func defLogLaTex(args ...ExprNode) string {
+func defLogLaTex(e *Engine, args ...ExprNode) string {
 	if len(args) != 2 {
-		panic(errors.New("calling function `log` must have two parameter."))
+		panic(&ArityError{Name: "log", Want: 2, Got: len(args)})
 	}
 
-	return fmt.Sprintf("\\log_{%s}^{%s}", ExprASTLaTex(args[0]), ExprASTLaTex(args[1]))
+	return fmt.Sprintf("\\log_{%s}^{%s}", e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[1]))
 }
 
 // lg
-func defLg(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Log10(ExprASTResult(expr[0], params))
+func defLg(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("lg", math.Log10, expr[0], params)
 }
 
-func defLgLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("\\lg{%s}", ExprASTLaTex(args[0]))
+func defLgLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\lg{%s}", e.ExprASTLaTex(args[0]))
 }
 
 // ln
-func defLn(params map[string]float64, expr ...ExprNode) float64 {
-	return math.Log10(ExprASTResult(expr[0], params)) / math.Log10(math.E)
+func defLn(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	return ev.math1("ln", ln, expr[0], params)
 }
 
-func defLnLaTex(args ...ExprNode) string {
-	return fmt.Sprintf("\\ln{%s}", ExprASTLaTex(args[0]))
+func defLnLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\ln{%s}", e.ExprASTLaTex(args[0]))
 }
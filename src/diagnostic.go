@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Severity 诊断级别
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+const (
+	// CodeUnboundIterator `#i` used outside of a sum body
+	CodeUnboundIterator ErrorCode = "unbound_iterator"
+)
+
+// Diagnostic 诊断信息
+type Diagnostic struct {
+	Span
+	Severity Severity
+	Code     ErrorCode
+	Message  string
+	// Err is the underlying error of SeverityError diagnostics
+	Err error
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Severity, withPos(d.Message, d.Span))
+}
+
+func newDiagnostic(severity Severity, err error) Diagnostic {
+	d := Diagnostic{Severity: severity, Code: CodeEval, Message: err.Error(), Err: err}
+	if e, ok := err.(Error); ok {
+		d.Span = e.Pos()
+		d.Code = e.Code()
+	}
+	if m, ok := err.(interface{ msg() string }); ok {
+		d.Message = m.msg()
+	}
+	return d
+}
+
+// BadExprNode 无法解析的源码区间，仅出现在 Check 返回的部分 AST 中
+type BadExprNode struct {
+	Span
+	Err error
+}
+
+func (b BadExprNode) String() string {
+	return fmt.Sprintf("BadExprNode:[%d:%d]", b.Start, b.End)
+}
+
+func (b BadExprNode) Children() []ExprNode {
+	return nil
+}
+
+func (b BadExprNode) WithChildren([]ExprNode) ExprNode {
+	return b
+}
+
+func (b BadExprNode) Result(*Engine, map[string]float64) float64 {
+	panic(b.Err)
+}
+
+func (b BadExprNode) LaTex(*Engine) string {
+	return "\\square"
+}
+
+// Check is a Top level function
+// parse s with the default engine reporting every problem found
+func Check(s string) (ExprNode, []Diagnostic) {
+	return std.Check(s)
+}
+
+// Check parse s without stopping at the first error:
+// the parser synchronizes on ',' and ')' and goes on, unparsable input becomes a BadExprNode.
+// returns the partial AST, nil if s has no token at all, and the diagnostics sorted by position
+func (e *Engine) Check(s string) (ExprNode, []Diagnostic) {
+	p := newParser(e, s)
+	p.recovering = true
+	toks := p.parse()
+	diags := p.diags
+	// an input over the limits is not parsed at all
+	if p.err != nil || len(toks) == 0 && len(diags) > 0 {
+		return nil, diags
+	}
+
+	a := e.NewAST(toks, s)
+	a.recovering = true
+	node := a.ParseExpression()
+	diags = append(diags, a.Diagnostics...)
+	diags = append(diags, lint(node)...)
+	sort.SliceStable(diags, func(i, j int) bool {
+		return diags[i].Start < diags[j].Start
+	})
+	return node, diags
+}
+
+// lint report suspicious but valid constructs
+func lint(node ExprNode) []Diagnostic {
+	var diags []Diagnostic
+	var visit func(n ExprNode, loop bool)
+	visit = func(n ExprNode, loop bool) {
+		switch n := n.(type) {
+		case nil:
+			return
+		case VariableExprNode:
+			if n.Val == "#i" && !loop {
+				diags = append(diags, Diagnostic{
+					Span:     n.Span,
+					Severity: SeverityWarning,
+					Code:     CodeUnboundIterator,
+					Message:  "`#i` is only bound inside the body of sum",
+				})
+			}
+		case OperatorExprNode:
+			if rhs, ok := n.Rhs.(NumberExprNode); ok && rhs.Val == 0 && (n.Op == "/" || n.Op == "%") {
+				diags = append(diags, Diagnostic{
+					Span:     n.Span,
+					Severity: SeverityWarning,
+					Code:     CodeDivisionByZero,
+					Message:  "division by zero",
+				})
+			}
+		case FunCallerExprNode:
+			if n.Name == "sum" {
+				for i, arg := range n.Arg {
+					visit(arg, loop || i == 2)
+				}
+				return
+			}
+		}
+		for _, child := range n.Children() {
+			visit(child, loop)
+		}
+	}
+	visit(node, false)
+	return diags
+}
@@ -0,0 +1,380 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// std 默认引擎，包级别函数均委托给它
+var std *Engine
+
+// Engine 表达式引擎
+// 每个引擎持有独立的函数表、常量表与三角函数模式，互不影响
+// 注册与求值可以在多个 goroutine 中并发进行
+type Engine struct {
+	// TrigonometricMode enum "RadianMode", "AngleMode"
+	// the default engine follows the package-level TrigonometricMode instead
+	TrigonometricMode int
+	// Limits bound the inputs parsed and the evaluations run by the engine
+	Limits Limits
+	// Precision is the mantissa size in bits of the evaluations of EvalBig, 0 means DefaultPrecision
+	Precision uint
+	// Decimal is the scale and rounding mode of EvalDecimal
+	Decimal DecimalContext
+	// StrictRat makes EvalRat fail with ErrInexact instead of falling back to float64
+	StrictRat bool
+
+	mu          sync.RWMutex
+	funcs       map[string]DefineFunc
+	consts      map[string]float64
+	constsLaTex map[string]string
+	ops         map[string]OperatorUnit
+	// opLen is the length of the longest operator symbol
+	opLen int
+}
+
+// NewEngine create an engine with a private copy of the builtin functions and constants
+func NewEngine() *Engine {
+	e := &Engine{
+		TrigonometricMode: RadianMode,
+		Limits:            DefaultLimits,
+		Decimal:           DefaultDecimal,
+		funcs:             make(map[string]DefineFunc, len(defFunc)),
+		consts:            make(map[string]float64, len(defConst)),
+		constsLaTex:       make(map[string]string, len(defConstLaTex)),
+		ops:               make(map[string]OperatorUnit, len(operators)),
+		opLen:             maxOperatorLen,
+	}
+	for k, v := range defFunc {
+		e.funcs[k] = v
+	}
+	for k, v := range defConst {
+		e.consts[k] = v
+	}
+	for k, v := range defConstLaTex {
+		e.constsLaTex[k] = v
+	}
+	for k, v := range operators {
+		e.ops[k] = v
+	}
+	return e
+}
+
+// DefaultEngine returns the engine used by the package-level functions
+func DefaultEngine() *Engine {
+	return std
+}
+
+func (e *Engine) lookupFunc(name string) (DefineFunc, bool) {
+	e.mu.RLock()
+	def, ok := e.funcs[name]
+	e.mu.RUnlock()
+	return def, ok
+}
+
+func (e *Engine) lookupConst(name string) (float64, bool) {
+	e.mu.RLock()
+	v, ok := e.consts[name]
+	e.mu.RUnlock()
+	return v, ok
+}
+
+func (e *Engine) lookupOperator(symbol string) (OperatorUnit, bool) {
+	e.mu.RLock()
+	op, ok := e.ops[symbol]
+	e.mu.RUnlock()
+	return op, ok
+}
+
+func (e *Engine) operatorLen() int {
+	e.mu.RLock()
+	n := e.opLen
+	e.mu.RUnlock()
+	return n
+}
+
+func (e *Engine) lookupConstLaTex(name string) string {
+	e.mu.RLock()
+	v := e.constsLaTex[name]
+	e.mu.RUnlock()
+	return v
+}
+
+func (e *Engine) trigonometricMode() int {
+	if e == std {
+		return TrigonometricMode
+	}
+	return e.TrigonometricMode
+}
+
+// ParseAndExec analytical expression and execution
+// err is not nil if an error occurs (including arithmetic runtime errors)
+func (e *Engine) ParseAndExec(s string, params map[string]float64) (r float64, err error) {
+	return e.exec(nil, s, params)
+}
+
+// EvalContext same as ParseAndExec, the evaluation stops as soon as ctx is done.
+// err wraps ctx.Err() on cancellation, ErrStepLimit or ErrIterationLimit when e.Limits is exceeded.
+// the arguments a function registered by RegFunction evaluates by itself are outside of the budget
+func (e *Engine) EvalContext(ctx context.Context, s string, params map[string]float64) (r float64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return e.exec(ctx, s, params)
+}
+
+// exec evaluate s for the float64 API: missing variables are 0 and booleans are 1 or 0
+func (e *Engine) exec(ctx context.Context, s string, params map[string]float64) (r float64, err error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	return floatResult(e.newFloatEvaluator(ctx).eval(ar, valueParams(params)), ar), err
+}
+
+// floatResult convert the value of the whole expression expr for the float64 API,
+// a value that is not a number is a *TypeError pointing at expr
+func floatResult(v Value, expr ExprNode) float64 {
+	if isQuantity(v) {
+		panic(&TypeError{
+			Span: expr.Pos(),
+			Want: "a number without unit (divide it by a unit as in to(x, m) / 1 m, or use EvalValue)",
+			Got:  v.Kind(),
+		})
+	}
+	defer locate(expr.Pos())
+	return resultFloat(v)
+}
+
+// EvalValue parse s and evaluate it with typed values, missing variables are Null
+func (e *Engine) EvalValue(s string, params map[string]Value) (v Value, err error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	return e.ExprASTValue(ar, params), nil
+}
+
+// parseExpr tokenize and parse s into an expression tree
+func (e *Engine) parseExpr(s string) (ExprNode, error) {
+	return e.parseExprWith(s, false)
+}
+
+// parseExprWith same as parseExpr, imaginary makes i the imaginary unit for EvalComplex
+func (e *Engine) parseExprWith(s string, imaginary bool) (ExprNode, error) {
+	toks, err := e.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	ast := e.NewAST(toks, s)
+	ast.imaginary = imaginary
+	if ast.Err != nil {
+		return nil, ast.Err
+	}
+	ar := ast.ParseExpression()
+	if ast.Err != nil {
+		return nil, ast.Err
+	}
+	return ar, nil
+}
+
+// RegFunction register a new function to use in expressions of this engine
+// the handler evaluates its arguments with the package-level ExprASTResult,
+// handlers that rely on engine specific definitions should close over the engine and use e.ExprASTResult.
+// params only holds the numeric variables
+func (e *Engine) RegFunction(name string, argc int, fun func(map[string]float64, ...ExprNode) float64, funLaTex func(...ExprNode) string) error {
+	return e.register("RegFunction", name, DefineFunc{
+		argc: argc,
+		fun: func(_ *evaluator, params map[string]Value, args ...ExprNode) Value {
+			return Number(fun(floatParams(params), args...))
+		},
+		funLaTex: wrapLaTex(funLaTex),
+	})
+}
+
+// RegValueFunction register a function working on typed values,
+// its arguments are evaluated before fun is called, a non-nil error aborts the evaluation
+func (e *Engine) RegValueFunction(name string, argc int, fun func(...Value) (Value, error), funLaTex func(...ExprNode) string) error {
+	return e.register("RegValueFunction", name, DefineFunc{
+		argc: argc,
+		fun: func(ev *evaluator, params map[string]Value, args ...ExprNode) Value {
+			values := make([]Value, len(args))
+			for i, arg := range args {
+				values[i] = ev.eval(arg, params)
+			}
+			v, err := fun(values...)
+			if err != nil {
+				panic(err)
+			}
+			return v
+		},
+		funLaTex: wrapLaTex(funLaTex),
+	})
+}
+
+func (e *Engine) register(by string, name string, def DefineFunc) error {
+	if len(name) == 0 {
+		return errors.New(by + " name is not empty")
+	}
+	if def.argc < -1 {
+		return errors.New(by + " argc should be -1, 0, or a positive integer")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.funcs[name]; ok {
+		return errors.New(by + " name is already exist")
+	}
+	if _, ok := e.ops[name]; ok {
+		return errors.New(by + " name is an operator")
+	}
+	e.funcs[name] = def
+	return nil
+}
+
+func wrapLaTex(funLaTex func(...ExprNode) string) func(*Engine, ...ExprNode) string {
+	if funLaTex == nil {
+		return defaultLaTexFunc
+	}
+	return func(_ *Engine, args ...ExprNode) string {
+		return funLaTex(args...)
+	}
+}
+
+// RegOperator register an operator to use in expressions of this engine.
+// symbol is a word such as xor or a run of punctuation such as // or **, the longest symbol wins when tokenizing.
+// precedence binds the operands like the builtin operators: + is 20, * is 40 and ^ is 60,
+// for a prefix operator it is the binding power of its operand, the unary minus has PrefixPrecedence.
+// eval receives both operands of an infix operator, the missing one of a prefix or postfix operator is 0.
+// latex may be nil, the missing operand is "" as well.
+// symbols already used by the grammar, by another operator or by a function, constant or unit are rejected,
+// so are the symbols that would change how a valid input is read, such as *- in 2*-3
+func (e *Engine) RegOperator(symbol string, kind OperatorKind, precedence int, assoc Associativity, eval func(a, b float64) float64, latex func(a, b string) string) error {
+	if !validSymbol(symbol) {
+		return errors.New("RegOperator symbol should be a word or a run of punctuation")
+	}
+	if kind < InfixOperator || kind > PostfixOperator {
+		return errors.New("RegOperator kind should be InfixOperator, PrefixOperator or PostfixOperator")
+	}
+	if precedence < 0 {
+		return errors.New("RegOperator precedence should not be negative")
+	}
+	if eval == nil {
+		return errors.New("RegOperator eval is nil")
+	}
+	if isSymbol(symbol) || isUnitName(symbol) {
+		return errors.New("RegOperator symbol is already exist")
+	}
+	if e.shadows(symbol) {
+		return errors.New("RegOperator symbol changes how the existing operators are read")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, op := e.ops[symbol]
+	_, fun := e.funcs[symbol]
+	_, con := e.consts[symbol]
+	if op || fun || con {
+		return errors.New("RegOperator symbol is already exist")
+	}
+	e.ops[symbol] = &customOperator{
+		name:       symbol,
+		kind:       kind,
+		precedence: precedence,
+		assoc:      assoc,
+		eval:       eval,
+		latex:      latex,
+	}
+	if len(symbol) > e.opLen {
+		e.opLen = len(symbol)
+	}
+	return nil
+}
+
+func (e *Engine) RegConst(name string, value float64) error {
+	if len(name) == 0 {
+		return errors.New("RegConst name is not empty")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.consts[name]; ok {
+		return errors.New("RegConst name is already exist")
+	}
+	if _, ok := e.ops[name]; ok {
+		return errors.New("RegConst name is an operator")
+	}
+	e.consts[name] = value
+	return nil
+}
+
+func (e *Engine) RegConstLaTex(name string, value string) error {
+	if len(name) == 0 {
+		return errors.New("RegConstLaTex name is not empty")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.constsLaTex[name]; ok {
+		return errors.New("RegConstLaTex name is already exist")
+	}
+	e.constsLaTex[name] = value
+	return nil
+}
+
+// ExprASTResult AST traversal
+// if an arithmetic runtime error occurs, a panic exception is thrown
+func (e *Engine) ExprASTResult(expr ExprNode, params map[string]float64) float64 {
+	return floatResult(e.newFloatEvaluator(nil).eval(expr, valueParams(params)), expr)
+}
+
+// ExprASTValue AST traversal with typed values
+// if a runtime error occurs, a panic exception is thrown
+func (e *Engine) ExprASTValue(expr ExprNode, params map[string]Value) Value {
+	return e.newEvaluator(nil, Null{}).eval(expr, params)
+}
+
+func (e *Engine) ExprASTLaTex(expr ExprNode) string {
+	var l, r string
+	switch expr.(type) {
+	case OperatorExprNode:
+		ast := expr.(OperatorExprNode)
+		l = e.ExprASTLaTex(ast.Lhs)
+		r = e.ExprASTLaTex(ast.Rhs)
+		op, _ := e.lookupOperator(ast.Op)
+		return op.ToLaTex(l, r)
+	case NumberExprNode:
+		return expr.(NumberExprNode).Str
+	case ConstExprNode:
+		node := expr.(ConstExprNode)
+		if tex := e.lookupConstLaTex(node.Name); tex != "" {
+			return tex
+		}
+		return expr.(ConstExprNode).Name
+	case VariableExprNode:
+		return expr.(VariableExprNode).Val[1:]
+	case FunCallerExprNode:
+		f := expr.(FunCallerExprNode)
+		def, _ := e.lookupFunc(f.Name)
+		return def.funLaTex(e, f.Arg...)
+	case ListExprNode:
+		return e.listLaTex(expr.(ListExprNode))
+	case QuantityExprNode:
+		q := expr.(QuantityExprNode)
+		if q.Val == nil {
+			return q.Unit.LaTex()
+		}
+		return e.ExprASTLaTex(q.Val) + "\\," + q.Unit.LaTex()
+	case LaTexNode:
+		return expr.(LaTexNode).LaTex(e)
+	}
+
+	return ""
+}
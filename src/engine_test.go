@@ -1,9 +1,17 @@
 package engine
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math"
+	"math/big"
+	"math/cmplx"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestParse(t *testing.T) {
@@ -37,3 +45,1485 @@ func TestNewAST(t *testing.T) {
 
 	log.Println("result = ", result)
 }
+
+func TestEngineIsolation(t *testing.T) {
+	a := NewEngine()
+	b := NewEngine()
+	a.TrigonometricMode = AngleMode
+	if err := a.RegFunction("double", 1, func(params map[string]float64, args ...ExprNode) float64 {
+		return a.ExprASTResult(args[0], params) * 2
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RegConst("k", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := a.ParseAndExec("double(sin(90)) + k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(r-5) > 1e-12 {
+		t.Errorf("engine a: want 5, get %v", r)
+	}
+
+	if _, err := b.ParseAndExec("double(1)", nil); err == nil {
+		t.Error("engine b must not see functions registered on engine a")
+	}
+	if _, err := ParseAndExec("k", nil); err == nil {
+		t.Error("default engine must not see constants registered on engine a")
+	}
+	r, err = b.ParseAndExec("sin(pi/2)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(r-1) > 1e-12 {
+		t.Errorf("engine b: want 1, get %v", r)
+	}
+}
+
+func TestParallelParseAndExec(t *testing.T) {
+	params := map[string]float64{"$x": 2}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				r, err := ParseAndExec("sum(1, 10, #i * $x) + sin(0)", params)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if r != 110 {
+					t.Errorf("want 110, get %v", r)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(params) != 1 {
+		t.Errorf("evaluation must not modify params, get %v", params)
+	}
+}
+
+func TestParallelRegister(t *testing.T) {
+	e := NewEngine()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				name := fmt.Sprintf("f%dx%d", g, n)
+				_ = e.RegConst(name, float64(n))
+				_ = e.RegConstLaTex(name, name)
+				_ = e.RegFunction(name, 0, func(map[string]float64, ...ExprNode) float64 { return 1 }, nil)
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				if _, err := e.ParseAndExec("max(1, 2) + pi", nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if r, err := e.ParseAndExec("f3x7() + f3x7", nil); err != nil || r != 8 {
+		t.Errorf("want 8, get %v %v", r, err)
+	}
+}
+
+func TestProgram(t *testing.T) {
+	params := map[string]float64{"$a": 0.1, "$b": 0.2, "$c": 3}
+	exprs := []string{
+		"$a + $b",
+		"8.1 - 8.11",
+		"-$c * 2 ^ 3 % 5",
+		"sin(pi/2) + cos(0) - tan(pi/4) + cot(pi/4) + sec(0) + csc(pi/2)",
+		"abs(-2) + ceil(4.2) + floor(4.8) + round(4.6) + sqrt(16) + cbrt(27)",
+		"max(1, $c, 2) - min(4, $a)",
+		"sum(1, 10) + sum(1, 4, #i * $c) + sum(1, 3, sum(1, 2, #i))",
+		"log(2, 8) + lg(100) + ln(e)",
+		"noerr(1/0) + noerr($c/($a-$a))",
+		"$a * 2 <= $b",
+		"1 == 1 == 1",
+		"1 < 2 < 3",
+		"(1 < 2) + 1",
+		"sqrt($a < $b) + !($c > 1) * 2",
+		"sum(1, 3, 0.1) + sum(1, 3, #i / 10)",
+	}
+	for _, s := range exprs {
+		want, err := ParseAndExec(s, params)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		p, err := Compile(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		got, err := p.Eval(params)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if got != want {
+			t.Errorf("%s: want %v, get %v", s, want, got)
+		}
+	}
+
+	// the terms of a sum are added like the operator + in every backend
+	if r, err := ParseAndExec("sum(1, 3, 0.1)", nil); err != nil || r != 0.3 {
+		t.Errorf("want 0.3, get %v, %v", r, err)
+	}
+
+	p, err := Compile("$c / ($a - $a)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Eval(params); err == nil {
+		t.Error("division by zero must be reported")
+	}
+}
+
+func TestProgramNoAlloc(t *testing.T) {
+	p, err := Compile("max($a, 2) * sin($b) + sum(1, 5, #i * $a) - ($a + $b) / 3 % 2 ^ 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]float64{"$a": 1.25, "$b": 0.5}
+	if n := testing.AllocsPerRun(100, func() {
+		if _, err := p.Eval(params); err != nil {
+			t.Fatal(err)
+		}
+	}); n != 0 {
+		t.Errorf("Program.Eval allocates %v times", n)
+	}
+}
+
+func TestProgramAngleMode(t *testing.T) {
+	e := NewEngine()
+	e.TrigonometricMode = AngleMode
+	p, err := e.Compile("sin(90)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mode is resolved at compile time
+	e.TrigonometricMode = RadianMode
+	if r, _ := p.Eval(nil); math.Abs(r-1) > 1e-12 {
+		t.Errorf("want 1, get %v", r)
+	}
+}
+
+func BenchmarkProgramEval(b *testing.B) {
+	p, _ := Compile("$a * 1.07 + max($b, 10) - $a / 3")
+	params := map[string]float64{"$a": 120, "$b": 7}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = p.Eval(params)
+	}
+}
+
+func BenchmarkParseAndExec(b *testing.B) {
+	params := map[string]float64{"$a": 120, "$b": 7}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = ParseAndExec("$a * 1.07 + max($b, 10) - $a / 3", params)
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	params := map[string]float64{"$a": 0.1, "$b": 0.2, "$c": 3}
+	exprs := []string{
+		"$a + $b",
+		"-$c * 2 ^ 3 % 5",
+		"sin(pi/2) + cos(0) - tan(pi/4) + max(1, $c, 2) - min(4, $a)",
+		"sum(1, 10) + sum(1, 4, #i * $c) + sum(1, 3, sum(1, 2, #i) * #i)",
+		"log(2, 8) + lg(100) + ln(e) + noerr(1/0) + noerr($c/($a-$a)) + 1",
+		"$a * 2 <= $b",
+		"1 == 1 == 1",
+		"1 < 2 < 3",
+		"(1 < 2) + 1",
+		"sqrt($a < $b) + !($c > 1) * 2",
+		"sum(1, 3, 0.1) + sum(1, 3, #i / 10)",
+	}
+	vm := NewVM(DefaultEngine())
+	for _, s := range exprs {
+		toks, err := Parse(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		ast := NewAST(toks, s)
+		node := ast.ParseExpression()
+		if ast.Err != nil {
+			t.Fatal(s, ast.Err)
+		}
+		b, err := CompileBytecode(node)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		data, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		var loaded Bytecode
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(s, err, "\n", b)
+		}
+		want := ExprASTResult(node, params)
+		got, err := vm.Run(&loaded, params)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if got != want {
+			t.Errorf("%s: want %v, get %v\n%s", s, want, got, b)
+		}
+	}
+}
+
+func TestBytecodeLimits(t *testing.T) {
+	toks, _ := Parse("sum(1, 1000, #i)")
+	node := NewAST(toks, "sum(1, 1000, #i)").ParseExpression()
+	b, err := CompileBytecode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(DefaultEngine())
+	vm.MaxSteps = 100
+	if _, err := vm.Run(b, nil); err != ErrStepLimit {
+		t.Errorf("want ErrStepLimit, get %v", err)
+	}
+
+	// the runtime errors point at the instruction raising them, also after a round trip
+	s := "1 + 2 / (1 - 1)"
+	toks, _ = Parse(s)
+	node = NewAST(toks, s).ParseExpression()
+	div, _ := CompileBytecode(node)
+	data, _ := div.MarshalBinary()
+	var loaded Bytecode
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	var dz *DivisionByZeroError
+	if _, err := NewVM(nil).Run(&loaded, nil); !errors.As(err, &dz) || dz.Span != (Span{4, 15}) {
+		t.Errorf("want a division by zero at [4:15], get %v", err)
+	}
+
+	data, _ = b.MarshalBinary()
+	for i := len(bytecodeMagic); i < len(data); i++ {
+		var loaded Bytecode
+		if loaded.UnmarshalBinary(data[:i]) == nil {
+			t.Errorf("truncated bytecode at %d must be rejected", i)
+		}
+	}
+}
+
+// squareNode is a node kind defined outside the builtin set
+type squareNode struct {
+	Span
+	X ExprNode
+}
+
+func (s squareNode) String() string                     { return "squareNode:" + s.X.String() }
+func (s squareNode) Children() []ExprNode               { return []ExprNode{s.X} }
+func (s squareNode) WithChildren(c []ExprNode) ExprNode { return squareNode{s.Span, c[0]} }
+func (s squareNode) LaTex(e *Engine) string             { return e.ExprASTLaTex(s.X) + "^{2}" }
+func (s squareNode) Result(e *Engine, p map[string]float64) float64 {
+	v := e.ExprASTResult(s.X, p)
+	return v * v
+}
+
+func parseForTest(t *testing.T, s string) ExprNode {
+	t.Helper()
+	toks, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ast := NewAST(toks, s)
+	node := ast.ParseExpression()
+	if ast.Err != nil {
+		t.Fatal(ast.Err)
+	}
+	return node
+}
+
+func TestWalkAndRewrite(t *testing.T) {
+	node := parseForTest(t, "max($a, 2) * sin($b) + $a ^ 2")
+
+	vars := map[string]int{}
+	Inspect(node, func(n ExprNode) bool {
+		if v, ok := n.(VariableExprNode); ok {
+			vars[v.Val]++
+		}
+		return true
+	})
+	if vars["$a"] != 2 || vars["$b"] != 1 {
+		t.Errorf("unexpected variables %v", vars)
+	}
+
+	// x ^ 2 -> squareNode{x}
+	rewritten := Rewrite(node, func(n ExprNode) ExprNode {
+		if o, ok := n.(OperatorExprNode); ok && o.Op == "^" {
+			if num, ok := o.Rhs.(NumberExprNode); ok && num.Val == 2 {
+				return squareNode{o.Span, o.Lhs}
+			}
+		}
+		return n
+	})
+	count := 0
+	Inspect(rewritten, func(n ExprNode) bool {
+		if _, ok := n.(squareNode); ok {
+			count++
+		}
+		return true
+	})
+	if count != 1 {
+		t.Fatalf("want one squareNode, get %d in %s", count, rewritten)
+	}
+	params := map[string]float64{"$a": 3, "$b": 0.5}
+	if want, got := ExprASTResult(node, params), ExprASTResult(rewritten, params); want != got {
+		t.Errorf("want %v, get %v", want, got)
+	}
+	if tex := ExprASTLaTex(rewritten); tex != " \\times sin(b) + a^{2}" {
+		t.Errorf("unexpected LaTeX %q", tex)
+	}
+	// the original tree is untouched
+	if _, ok := node.(OperatorExprNode).Rhs.(OperatorExprNode); !ok {
+		t.Errorf("Rewrite must not modify its input, get %s", node)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	s := "max($a, 2) + (3 - 1) * pi"
+	node := parseForTest(t, s)
+	var got []string
+	Inspect(node, func(n ExprNode) bool {
+		if n != nil {
+			got = append(got, s[n.Pos().Start:n.Pos().End])
+		}
+		return true
+	})
+	want := []string{"max($a, 2) + (3 - 1) * pi", "max($a, 2)", "$a", "2", "(3 - 1) * pi", "(3 - 1)", "3", "1", "pi"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want %q, get %q", want, got)
+	}
+}
+
+func TestEvalErrorSpan(t *testing.T) {
+	s := "1 + max(2, $a / ($b - 1)) * 3"
+	params := map[string]float64{"$a": 1, "$b": 1}
+	check := func(err error) {
+		t.Helper()
+		var ee *DivisionByZeroError
+		if !errors.As(err, &ee) {
+			t.Fatalf("want *DivisionByZeroError, get %v", err)
+		}
+		if sub := s[ee.Start:ee.End]; sub != "$a / ($b - 1)" {
+			t.Errorf("want the division to be located, get %q", sub)
+		}
+	}
+	_, err := ParseAndExec(s, params)
+	check(err)
+
+	p, err := Compile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Eval(params)
+	check(err)
+}
+
+func TestErrorTypes(t *testing.T) {
+	cases := []struct {
+		s    string
+		code ErrorCode
+		pos  Span
+	}{
+		{"", CodeEmptyExpression, Span{0, 0}},
+		{"1 + @", CodeUnknownSymbol, Span{4, 5}},
+		{"1 +", CodeUnexpectedEOF, Span{3, 3}},
+		{"(1 + 2", CodeUnexpectedEOF, Span{6, 6}},
+		{"max(1, 2", CodeUnexpectedEOF, Span{8, 8}},
+		{"1 2", CodeUnexpectedToken, Span{2, 3}},
+		{"foo(1)", CodeUndefinedFunction, Span{0, 3}},
+		{"2 * bar", CodeUndefinedConst, Span{4, 7}},
+		{"1 + log(2)", CodeArity, Span{4, 10}},
+		{"max()", CodeArity, Span{0, 5}},
+		{"2 * (3 % (1 - 1))", CodeDivisionByZero, Span{4, 17}},
+	}
+	for _, c := range cases {
+		_, err := ParseAndExec(c.s, nil)
+		var e Error
+		if !errors.As(err, &e) {
+			t.Errorf("%q: want Error, get %v", c.s, err)
+			continue
+		}
+		if e.Code() != c.code || e.Pos() != c.pos {
+			t.Errorf("%q: want %s at %v, get %s at %v (%v)", c.s, c.code, c.pos, e.Code(), e.Pos(), err)
+		}
+	}
+
+	_, err := ParseAndExec("1 + log(2)", nil)
+	var arity *ArityError
+	if !errors.As(err, &arity) || arity.Name != "log" || arity.Want != 2 || arity.Got != 1 {
+		t.Errorf("unexpected arity error %#v", arity)
+	}
+	if msg := FormatError(err, "1 + log(2)"); msg != err.Error()+"\n"+ErrPos("1 + log(2)", 4) {
+		t.Errorf("unexpected rendering\n%s", msg)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s := "max(1 +, foo(2), 3 @ 4) + bar + (1 2"
+	node, diags := Check(s)
+	want := []struct {
+		code ErrorCode
+		at   int
+	}{
+		{CodeUnexpectedToken, 7},
+		{CodeUndefinedFunction, 9},
+		{CodeUnknownSymbol, 19},
+		{CodeUnexpectedToken, 21},
+		{CodeUndefinedConst, 26},
+		{CodeMissingParen, 35},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("want %d diagnostics, get %v", len(want), diags)
+	}
+	for i, w := range want {
+		if diags[i].Code != w.code || diags[i].Start != w.at || diags[i].Severity != SeverityError {
+			t.Errorf("diagnostic %d: want %s at %d, get %v", i, w.code, w.at, diags[i])
+		}
+	}
+	// the partial AST still holds the parsable parts
+	names := map[string]bool{}
+	Inspect(node, func(n ExprNode) bool {
+		switch n := n.(type) {
+		case FunCallerExprNode:
+			names[n.Name] = true
+		case ConstExprNode:
+			names[n.Name] = true
+		}
+		return true
+	})
+	if !names["max"] || !names["foo"] || !names["bar"] {
+		t.Errorf("partial AST misses nodes: %s", node)
+	}
+
+	_, diags = Check("sum(1, 3, #i) + #i / 0")
+	if len(diags) != 2 || diags[0].Severity != SeverityWarning || diags[1].Severity != SeverityWarning {
+		t.Errorf("want two warnings, get %v", diags)
+	}
+
+	if _, diags = Check("sin(pi / 2) * $x"); len(diags) != 0 {
+		t.Errorf("want no diagnostic, get %v", diags)
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	e := NewEngine()
+	r, err := e.EvalContext(context.Background(), "sum(1, 100, #i * 2)", nil)
+	if err != nil || r != 10100 {
+		t.Fatalf("want 10100, get %v, %v", r, err)
+	}
+
+	// a long sum stops once the deadline is reached
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = e.EvalContext(ctx, "sum(1, 1000000000, #i * 2)", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, get %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("evaluation stopped after %v", d)
+	}
+	var ee *EvalError
+	if !errors.As(err, &ee) || ee.Code() != CodeCanceled {
+		t.Errorf("want a canceled EvalError, get %#v", err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = e.EvalContext(canceled, "1 + 1", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("want canceled, get %v", err)
+	}
+
+	e.Limits = Limits{MaxSteps: 100}
+	_, err = e.EvalContext(context.Background(), "sum(1, 1000, #i)", nil)
+	if !errors.Is(err, ErrStepLimit) || !errors.As(err, &ee) || ee.Code() != CodeLimit {
+		t.Errorf("want step limit, get %v", err)
+	}
+	// noerr does not swallow an exhausted budget
+	if _, err = e.ParseAndExec("noerr(sum(1, 1000))", nil); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("want step limit through noerr, get %v", err)
+	}
+
+	e.Limits = Limits{MaxIterations: 1000}
+	for _, s := range []string{"sum(1, 1001)", "sum(1, 100, sum(1, 11, #i))"} {
+		if _, err = e.ParseAndExec(s, nil); !errors.Is(err, ErrIterationLimit) {
+			t.Errorf("%s: want iteration limit, get %v", s, err)
+		}
+		if _, err = e.Compile(s); !errors.Is(err, ErrIterationLimit) {
+			t.Errorf("%s: want iteration limit when compiling, get %v", s, err)
+		}
+	}
+	if r, err = e.ParseAndExec("sum(1, 100, sum(1, 9, 1))", nil); err != nil || r != 900 {
+		t.Errorf("want 900, get %v, %v", r, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	e := NewEngine()
+	e.Limits = Limits{MaxLength: 20, MaxTokens: 12, MaxDepth: 3, MaxArgs: 3}
+	cases := []struct {
+		s     string
+		limit string
+	}{
+		{"1 + 2 + 3 + 4 + 5 + 6", "MaxLength"},
+		{"1+2+3+4+5+6+7", "MaxTokens"},
+		{"((((1))))", "MaxDepth"},
+		{"---1", "MaxDepth"},
+		{"max(1, 2, 3, 4)", "MaxArgs"},
+	}
+	for _, c := range cases {
+		_, err := e.ParseAndExec(c.s, nil)
+		var le *LimitError
+		if !errors.As(err, &le) || le.Limit != c.limit || le.Code() != CodeLimit {
+			t.Errorf("%s: want %s limit error, get %v", c.s, c.limit, err)
+			continue
+		}
+		_, diags := e.Check(c.s)
+		if len(diags) != 1 || diags[0].Code != CodeLimit {
+			t.Errorf("%s: want one limit diagnostic, get %v", c.s, diags)
+		}
+	}
+	for _, s := range []string{"((1))", "--1", "max(1, 2, 3)", "1+2+3+4"} {
+		if _, err := e.ParseAndExec(s, nil); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+
+	// tokens built by hand are checked by the AST too
+	toks, _ := NewEngine().Parse("1+2+3+4+5+6+7")
+	if a := e.NewAST(toks, "1+2+3+4+5+6+7"); a.Err == nil || a.ParseExpression() != nil {
+		t.Errorf("want the AST to reject too many tokens, get %v", a.Err)
+	}
+
+	// the default limits turn a deep nesting into an error instead of a stack overflow
+	deep := strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000)
+	if _, err := ParseAndExec(deep, nil); err == nil {
+		t.Error("want an error on a deeply nested expression")
+	}
+
+	// a right-associative chain nests its right operands
+	shallow := NewEngine()
+	shallow.Limits.MaxDepth = 10
+	var le *LimitError
+	if _, err := shallow.ParseAndExec(strings.Repeat("1^", 50)+"1", nil); !errors.As(err, &le) || le.Limit != "MaxDepth" {
+		t.Errorf("want a MaxDepth error on a chain of ^, get %v", err)
+	}
+	if _, err := ParseAndExec(strings.Repeat("1^", 100000)+"1", nil); !errors.As(err, &le) || le.Limit != "MaxDepth" {
+		t.Errorf("want a MaxDepth error on a long chain of ^, get %v", err)
+	}
+	if _, err := shallow.ParseAndExec(strings.Repeat("1+", 50)+"1", nil); !errors.As(err, &le) || le.Limit != "MaxDepth" {
+		t.Errorf("want a MaxDepth error on a chain of +, get %v", err)
+	}
+	// a flat chain would build a degenerate tree overflowing the stack of the evaluator
+	if _, err := ParseAndExec(strings.Repeat("1+", 1000000)+"1", nil); !errors.As(err, &le) || le.Limit != "MaxDepth" {
+		t.Errorf("want a MaxDepth error on a long chain of +, get %v", err)
+	}
+	if _, err := shallow.ParseAndExec(strings.Repeat("1 ? 1 : ", 50)+"1", nil); !errors.As(err, &le) || le.Limit != "MaxDepth" {
+		t.Errorf("want a MaxDepth error on a chain of conditionals, get %v", err)
+	}
+	if _, err := shallow.ParseAndExec(strings.Repeat("0 ? 1 : ", 5)+"1", nil); err != nil {
+		t.Errorf("want a short chain of conditionals to pass, get %v", err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	e := NewEngine()
+	cases := []struct {
+		s    string
+		want Value
+	}{
+		{"9007199254740993 + 0", Integer(9007199254740993)},
+		{"2^62", Integer(1 << 62)},
+		{"2^64", Number(math.Pow(2, 64))},
+		{"9223372036854775807 + 1", Number(9223372036854775808)},
+		{"7 % 3", Integer(1)},
+		{"1 / 2", Number(0.5)},
+		{"6 / 3", Number(2)},
+		{"2^-1", Number(0.5)},
+		{"1.5 * 2", Number(3)},
+		{"abs(-3)", Integer(3)},
+		{"max(1, 2.5, 2)", Number(2.5)},
+		{"min(3, 1, 2)", Integer(1)},
+		{"sum(1, 4, #i * #i)", Integer(30)},
+		{"$s", String("a")},
+		{"$l", List{Integer(1), Bool(true)}},
+		{"$m", Null{}},
+	}
+	params := map[string]Value{"$s": String("a"), "$l": List{Integer(1), Bool(true)}}
+	for _, c := range cases {
+		v, err := e.EvalValue(c.s, params)
+		if err != nil || v.Kind() != c.want.Kind() || v.String() != c.want.String() {
+			t.Errorf("%s: want %s %v, get %v, %v", c.s, c.want.Kind(), c.want, v, err)
+		}
+	}
+
+	_, err := e.EvalValue("$s + 1", params)
+	var te *TypeError
+	if !errors.As(err, &te) || te.Got != StringKind || te.Op != "+" || te.Code() != CodeType {
+		t.Errorf("want a type error, get %v", err)
+	}
+	_, err = e.EvalValue("sqrt($s)", params)
+	if !errors.As(err, &te) || te.Span != (Span{5, 7}) {
+		t.Errorf("want a type error at the argument, get %v", err)
+	}
+
+	err = e.RegValueFunction("even", 1, func(args ...Value) (Value, error) {
+		n, ok := args[0].(Integer)
+		if !ok {
+			return nil, fmt.Errorf("even wants an integer")
+		}
+		return Bool(n%2 == 0), nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := e.EvalValue("even(2 + 2)", nil); err != nil || v != Bool(true) {
+		t.Errorf("want true, get %v, %v", v, err)
+	}
+	if _, err := e.EvalValue("even(0.5)", nil); err == nil {
+		t.Error("want the error of the handler")
+	}
+	// the float64 API still works, booleans become 1 or 0
+	if r, err := e.ParseAndExec("even(4)", nil); err != nil || r != 1 {
+		t.Errorf("want 1, get %v, %v", r, err)
+	}
+
+	v, err := ValueOf([]interface{}{1, "a", nil, 2.5})
+	if err != nil || v.String() != `[1, "a", null, 2.5]` {
+		t.Errorf("ValueOf: get %v, %v", v, err)
+	}
+}
+
+func TestEvalBig(t *testing.T) {
+	e := NewEngine()
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{"1/3 * 3", "1"},
+		{"2^100 + 1", "1267650600228229401496703205377"},
+		{"pi", "3.141592653589793238462643383279502884197169399375105820974944592307816"},
+		{"sqrt(2)", "1.414213562373095048801688724209698078569671875376948073176679737990732"},
+		{"ln(2)", "0.6931471805599453094172321214581765680755001343602552541206800094933936"},
+		{"log(2, 8)", "3"},
+		{"cbrt(27)", "3"},
+		{"sin(pi/6)", "0.5"},
+		{"cos(pi)", "-1"},
+		{"floor(-2.5) + round(2.5)", "0"},
+		{"max(1, 2.5, 2)", "2.5"},
+		{"0.1 + 0.2", "0.3"},
+		{"sum(1, 4, #i * #i)", "30"},
+		{"$x * 2", "3"},
+		{"25!", "15511210043330985984000000"},
+		{"31!!", "191898783962510625"},
+		{"im($x) + re($x)", "1.5"},
+		{"e^(2^40 + 0.5) > 0", "1"},
+	}
+	params := map[string]*big.Float{"$x": big.NewFloat(1.5)}
+	for _, c := range cases {
+		r, err := e.EvalBig(c.s, params)
+		if err != nil {
+			t.Errorf("%s: %v", c.s, err)
+			continue
+		}
+		if s := r.Text('g', 70); s != c.want {
+			t.Errorf("%s: want %s, get %s", c.s, c.want, s)
+		}
+	}
+
+	e.Precision = 1000
+	r, _ := e.EvalBig("1/3", nil)
+	if r.Prec() != 1000 {
+		t.Errorf("want a precision of 1000 bits, get %d", r.Prec())
+	}
+	var dz *DivisionByZeroError
+	if _, err := e.EvalBig("1/(1-1)", nil); !errors.As(err, &dz) || dz.Span != (Span{0, 7}) {
+		t.Errorf("want a division by zero, get %v", err)
+	}
+	if _, err := e.EvalBig("sqrt(-1)", nil); err == nil {
+		t.Error("want an error on the square root of a negative number")
+	}
+	// no float64 result is given for a function without a big.Float version
+	if _, err := e.EvalBig("0.5!", nil); !errors.Is(err, ErrInexact) {
+		t.Errorf("0.5!: want ErrInexact, get %v", err)
+	}
+	for _, s := range []string{"sin(10^100000)", "100000!"} {
+		var ee *EvalError
+		if _, err := e.EvalBig(s, nil); !errors.Is(err, ErrBigTooLarge) || !errors.As(err, &ee) || ee.Code() != CodeLimit {
+			t.Errorf("%s: want ErrBigTooLarge, get %v", s, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := e.EvalBigContext(ctx, "1", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("want a cancellation, get %v", err)
+	}
+	e.Limits.MaxSteps = 10
+	if _, err := e.EvalBigContext(context.Background(), "sum(1, 100, #i)", nil); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("want the step limit, get %v", err)
+	}
+}
+
+func TestEvalRat(t *testing.T) {
+	e := NewEngine()
+	cases := []struct {
+		s    string
+		want Value
+	}{
+		{"1/3 + 1/3 + 1/3", Rational{big.NewRat(1, 1)}},
+		{"0.1 + 0.2", Rational{big.NewRat(3, 10)}},
+		{"(2/3)^-2", Rational{big.NewRat(9, 4)}},
+		{"7 % 3 - $x", Rational{big.NewRat(3, 4)}},
+		{"sqrt(9/4) + abs(-1/2)", Rational{big.NewRat(2, 1)}},
+		{"floor(-5/2) + round(5/2) + ceil(1/3)", Rational{big.NewRat(1, 1)}},
+		{"max(1/3, 1/4)", Rational{big.NewRat(1, 3)}},
+		{"sqrt(4) * 2^0.5", Number(2 * math.Sqrt2)},
+	}
+	params := map[string]*big.Rat{"$x": big.NewRat(1, 4)}
+	for _, c := range cases {
+		v, err := e.EvalRat(c.s, params)
+		if err != nil || v.Kind() != c.want.Kind() || v.String() != c.want.String() {
+			t.Errorf("%s: want %s %v, get %v, %v", c.s, c.want.Kind(), c.want, v, err)
+		}
+	}
+
+	v, _ := e.EvalRat("1/3 - 1", nil)
+	if r, ok := v.(Rational); !ok || r.String() != "-2/3" || e.ExprASTLaTex(r.Node()) != "\\frac{-2}{3}" {
+		t.Errorf("want -2/3, get %v", v)
+	}
+
+	e.StrictRat = true
+	for _, s := range []string{"sqrt(2)", "2^0.5", "pi", "sin(1)"} {
+		if _, err := e.EvalRat(s, nil); !errors.Is(err, ErrInexact) {
+			t.Errorf("%s: want ErrInexact, get %v", s, err)
+		}
+	}
+	if v, err := e.EvalRat("sqrt(1/4)", nil); err != nil || v.String() != "1/2" {
+		t.Errorf("want 1/2, get %v, %v", v, err)
+	}
+
+	// a power is bounded by the size of its result, not only by its exponent
+	if v, err := e.EvalRat("2^65536 / 2^65535", nil); err != nil || v.String() != "2" {
+		t.Errorf("want 2, get %v, %v", v, err)
+	}
+	var ee *EvalError
+	if _, err := e.EvalRat("(2^65536)^65536", nil); !errors.Is(err, ErrRatTooLarge) || !errors.As(err, &ee) || ee.Code() != CodeLimit {
+		t.Errorf("want ErrRatTooLarge, get %v", err)
+	}
+}
+
+func TestEvalDecimal(t *testing.T) {
+	e := NewEngine()
+	cases := []struct {
+		s    string
+		ctx  DecimalContext
+		want string
+	}{
+		{"0.1 + 0.2", DefaultDecimal, "0.30"},
+		{"10 / 3", DefaultDecimal, "3.33"},
+		{"$p * 3", DefaultDecimal, "59.97"},
+		{"0.125 + 0", DecimalContext{2, RoundHalfEven}, "0.12"},
+		{"0.125 + 0", DecimalContext{2, RoundHalfUp}, "0.13"},
+		{"-0.125 + 0", DecimalContext{2, RoundHalfUp}, "-0.13"},
+		{"0.129 + 0", DecimalContext{2, RoundDown}, "0.12"},
+		{"2 / 3", DecimalContext{4, RoundHalfEven}, "0.6667"},
+		{"round(2.5) + round(3.5)", DefaultDecimal, "6.00"},
+		{"round(2.5)", DecimalContext{0, RoundHalfUp}, "3"},
+		{"round(1.23456, 3)", DecimalContext{6, RoundDown}, "1.234000"},
+		{"round(1234.5, -2)", DefaultDecimal, "1200.00"},
+		{"ceil(-1.5) + floor(1.5)", DefaultDecimal, "0.00"},
+		{"1.1^2 + 7 % 4", DecimalContext{3, RoundHalfEven}, "4.210"},
+		{"sqrt(2)", DefaultDecimal, "1.41"},
+	}
+	price, _ := ParseDecimal("19.99")
+	for _, c := range cases {
+		e.Decimal = c.ctx
+		d, err := e.EvalDecimal(c.s, map[string]Decimal{"$p": price})
+		if err != nil || d.String() != c.want {
+			t.Errorf("%s: want %s, get %v, %v", c.s, c.want, d, err)
+		}
+	}
+
+	if d, err := ParseDecimal("-1.5e-2"); err != nil || d.String() != "-0.015" || d.Scale() != 3 {
+		t.Errorf("ParseDecimal: get %v, %v", d, err)
+	}
+	// round with digits also works on numbers
+	if r, err := ParseAndExec("round(3.14159, 2)", nil); err != nil || r != 3.14 {
+		t.Errorf("want 3.14, get %v, %v", r, err)
+	}
+	p, err := Compile("round(3.14159, 3) + round(1234, -2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := p.Eval(nil); err != nil || r != 1203.142 {
+		t.Errorf("want 1203.142, get %v, %v", r, err)
+	}
+	if _, err := ParseAndExec("round(1, 0.5)", nil); err == nil {
+		t.Error("want an error on a fractional number of digits")
+	}
+}
+
+func TestEvalComplex(t *testing.T) {
+	e := NewEngine()
+	cases := []struct {
+		s    string
+		want complex128
+	}{
+		{"sqrt(-1)", 1i},
+		{"i^2", -1},
+		{"(1 + 2*i) * (3 - i)", 5 + 5i},
+		{"ln(-2)", complex(math.Ln2, math.Pi)},
+		{"e^(i*pi)", cmplx.Exp(1i * math.Pi)},
+		{"abs(3 + 4*i)", 5},
+		{"re($z) + im($z)", 3},
+		{"arg(i)", math.Pi / 2},
+		{"conj($z)", 1 - 2i},
+		{"cos(i)", complex(math.Cosh(1), 0)},
+		{"log(10, -100)", cmplx.Log10(-100)},
+		{"2 + 3", 5},
+	}
+	params := map[string]complex128{"$z": 1 + 2i}
+	for _, c := range cases {
+		z, err := e.EvalComplex(c.s, params)
+		if err != nil || cmplx.Abs(z-c.want) > 1e-12 {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, z, err)
+		}
+	}
+	if _, err := e.EvalComplex("max(i, 1)", nil); err == nil {
+		t.Error("want an error comparing complex numbers")
+	}
+
+	// i only exists in EvalComplex, the real modes do not know it and it can still be registered
+	var ce *UndefinedConstError
+	if _, err := e.ParseAndExec("sqrt(-1) + i", nil); !errors.As(err, &ce) || ce.Name != "i" {
+		t.Errorf("want i to be undefined, get %v", err)
+	}
+	if err := e.RegConst("i", 2); err != nil {
+		t.Errorf("want i to be free, get %v", err)
+	}
+	if r, err := e.ParseAndExec("i + 1", nil); err != nil || r != 3 {
+		t.Errorf("want 3, get %v, %v", r, err)
+	}
+	if r, err := e.ParseAndExec("re(2) + im(2) + arg(-2)", nil); err != nil || r != 2+math.Pi {
+		t.Errorf("want 2+pi, get %v, %v", r, err)
+	}
+	for z, want := range map[Complex]string{3 + 4i: "3 + 4i", -1i: "-i", 2: "2", -0.5 - 1.5i: "-0.5 - 1.5i"} {
+		if s := z.LaTex(); s != want {
+			t.Errorf("LaTex: want %s, get %s", want, s)
+		}
+	}
+}
+
+func TestEvalInterval(t *testing.T) {
+	e := NewEngine()
+	params := map[string]Interval{"$x": {-1, 2}, "$y": {3, 4}, "$z": {-1, 1}}
+	cases := []struct {
+		s    string
+		want Interval
+	}{
+		{"$x + $y", Interval{2, 6}},
+		{"$x - $x", Interval{-3, 3}},
+		{"$x * $y", Interval{-4, 8}},
+		{"$y / $y", Interval{0.75, 4.0 / 3}},
+		{"$x^2", Interval{0, 4}},
+		{"1 / $x", Interval{math.Inf(-1), math.Inf(1)}},
+		{"1 / ($x + 1)", Interval{0.3333333333333333, math.Inf(1)}},
+		{"cos($z)", Interval{math.Cos(1), 1}},
+		{"sin($y)", Interval{math.Sin(4), math.Sin(3)}},
+		{"sin($x + $y)", Interval{-1, math.Sin(2)}},
+		{"abs($x)", Interval{0, 2}},
+		{"max($x, $z)", Interval{-1, 2}},
+		{"tan($z * 2)", Interval{math.Inf(-1), math.Inf(1)}},
+		{"7 % 3", Interval{1, 1}},
+		{"$y % 3", Interval{0, 1}},
+		{"$y % 2", Interval{0, 1}},
+		{"$x % 3", Interval{-1, 2}},
+		{"$x * 5 % $y", Interval{-3, 3}},
+		{"-$y % 3", Interval{-1, 0}},
+		{"$x == $x", Interval{0, 1}},
+		{"$x != $z", Interval{0, 1}},
+		{"$x < $z", Interval{0, 1}},
+		{"$x < $y", Interval{1, 1}},
+		{"$y == 5", Interval{0, 0}},
+		{"7 % 3 == 1", Interval{1, 1}},
+		{"$y!", Interval{6, 24}},
+		{"($z / 2)!", Interval{gammaMinY, math.Gamma(0.5)}},
+		{"$z!", entire},
+		{"(-$y / 10)!", Interval{math.Gamma(0.7), math.Gamma(0.6)}},
+		{"$y!!", Interval{3, 8}},
+		{"$x!!", Interval{1, 2}},
+		{"$y%", Interval{0.03, 0.04}},
+		{"$y% * 100", Interval{3, 4}},
+	}
+	for _, c := range cases {
+		r, err := e.EvalInterval(c.s, params)
+		if err != nil {
+			t.Errorf("%s: %v", c.s, err)
+			continue
+		}
+		// the bounds may be one ulp outside of the exact ones
+		if math.Abs(r.Lo-c.want.Lo) > 1e-15 && r.Lo != c.want.Lo || math.Abs(r.Hi-c.want.Hi) > 1e-15 && r.Hi != c.want.Hi ||
+			!r.Contains(c.want.Lo) || !r.Contains(c.want.Hi) {
+			t.Errorf("%s: want %v, get %v", c.s, c.want, r)
+		}
+	}
+
+	// the result encloses the value of every point of the box
+	r, _ := e.EvalInterval("0.1 * 3", nil)
+	if !r.Contains(0.1*3) || !r.Contains(0.3) {
+		t.Errorf("want an enclosure of 0.3, get %v", r)
+	}
+	if _, err := e.EvalInterval("sqrt($x - 3)", params); err == nil {
+		t.Error("want an error outside of the domain of sqrt")
+	}
+	var dz *DivisionByZeroError
+	if _, err := e.EvalInterval("1 / ($z - $z)", map[string]Interval{"$z": {1, 1}}); !errors.As(err, &dz) {
+		t.Errorf("want a division by zero, get %v", err)
+	}
+	if _, err := e.EvalInterval("$y % 0.5", params); !errors.As(err, &dz) {
+		t.Errorf("want a mod by zero, get %v", err)
+	}
+	// a function without an interval version is widened around its float64 result
+	r, _ = e.EvalInterval("im($h)", map[string]Interval{"$h": {0.5, 0.5}})
+	if r.Lo >= 0 || r.Hi <= 0 {
+		t.Errorf("want an interval around 0, get %v", r)
+	}
+	if r, _ := e.EvalInterval("$h!", map[string]Interval{"$h": {0.5, 0.5}}); r.Lo == r.Hi || !r.Contains(math.Gamma(1.5)) {
+		t.Errorf("want an interval around Γ(1.5), get %v", r)
+	}
+	if _, err := e.EvalInterval("(-$y)!!", params); err == nil {
+		t.Error("want an error, the double factorial is not defined below -1")
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	e := NewEngine()
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{"[1, 2] + [3, 4]", "[4, 6]"},
+		{"[1, 2] * 3", "[3, 6]"},
+		{"2 - [1, 2]", "[1, 0]"},
+		{"[1, 2] * [3, 4]", "[3, 8]"},
+		{"[[1, 2], [3, 4]] * [[5, 6], [7, 8]]", "[[19, 22], [43, 50]]"},
+		{"[[1, 2], [3, 4]] * [1, 1]", "[3, 7]"},
+		{"[1, 1] * [[1, 2], [3, 4]]", "[4, 6]"},
+		{"[[1, 1], [0, 1]]^3", "[[1, 3], [0, 1]]"},
+		{"[[2, 0], [0, 4]]^-1", "[[0.5, 0], [0, 0.25]]"},
+		{"dot([1, 2, 3], [4, 5, 6])", "32"},
+		{"cross([1, 0, 0], [0, 1, 0])", "[0, 0, 1]"},
+		{"norm([3, 4])", "5"},
+		{"det([[1, 2], [3, 4]])", "-2"},
+		{"det([[0, 1], [1, 0]])", "-1"},
+		{"inv([[2, 0], [0, 4]])", "[[0.5, 0], [0, 0.25]]"},
+		{"transpose([[1, 2], [3, 4]])", "[[1, 3], [2, 4]]"},
+		{"transpose([1, 2])", "[[1, 2]]"},
+		{"[$x, $x^2]", "[3, 9]"},
+	}
+	params := map[string]Value{"$x": Integer(3)}
+	for _, c := range cases {
+		v, err := e.EvalValue(c.s, params)
+		if err != nil || v.String() != c.want {
+			t.Errorf("%s: want %s, get %v, %v", c.s, c.want, v, err)
+		}
+	}
+
+	// the items keep the exact arithmetic of EvalRat
+	if v, err := e.EvalRat("inv([[1, 2], [3, 4]])", nil); err != nil || v.String() != "[[-2, 1], [3/2, -1/2]]" {
+		t.Errorf("want an exact inverse, get %v, %v", v, err)
+	}
+	var te *TypeError
+	if _, err := e.EvalValue("[1, 2] + [1, 2, 3]", nil); !errors.As(err, &te) {
+		t.Errorf("want a type error, get %v", err)
+	}
+	if _, err := e.EvalValue("inv([[1, 2], [2, 4]])", nil); err == nil {
+		t.Error("want an error for a singular matrix")
+	}
+	for _, s := range []string{"[[1, 1], [0, 1]]^1e300", "[[1, 1], [0, 1]]^(1e308 * 10)"} {
+		if _, err := e.EvalValue(s, nil); err == nil {
+			t.Errorf("%s: want an error for an exponent out of range", s)
+		}
+	}
+	limited := NewEngine()
+	limited.Limits.MaxSteps = 20
+	if _, err := limited.EvalValue("[[1, 1], [0, 1]]^(2^50)", nil); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("want the step limit, get %v", err)
+	}
+
+	tex := ExprASTLaTex(parseForTest(t, "det([[1, 2], [3, 4]]) * [1, 2]"))
+	want := "\\det\\left(\\begin{bmatrix}1 & 2 \\\\ 3 & 4\\end{bmatrix}\\right) \\times \\begin{bmatrix}1 \\\\ 2\\end{bmatrix}"
+	if tex != want {
+		t.Errorf("want %q, get %q", want, tex)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	e := NewEngine()
+	v, err := ParseUnit("m/s")
+	if err != nil || v.String() != "m/s" {
+		t.Fatalf("ParseUnit: get %v, %v", v, err)
+	}
+	params := map[string]Value{"$v": Quantity{Val: Integer(3), Unit: v}}
+	cases := []struct {
+		s    string
+		want string
+	}{
+		{"3 m", "3 m"},
+		{"$v * 2 s", "6 m"},
+		{"5 km/h", "5 km/h"},
+		{"3 m / 2 s", "1.5 m/s"},
+		{"1 km + 300 m", "1.3 km"},
+		{"-3 m", "-3 m"},
+		{"(2 m)^2", "4 m^2"},
+		{"sqrt(9 m^2)", "3 m"},
+		{"10 N / 2 kg", "5 N/kg"},
+		{"1 h / 1 min", "60"},
+		{"to(5 km/h, m/s)", "1.3888888888888888 m/s"},
+		{"to($v, km/h)", "10.8 km/h"},
+		{"round(to(1 mi, km), 2)", "1.61 km"},
+		{"[1, 2] * 1 m", "[1 m, 2 m]"},
+	}
+	for _, c := range cases {
+		v, err := e.EvalValue(c.s, params)
+		if err != nil || v.String() != c.want {
+			t.Errorf("%s: want %s, get %v, %v", c.s, c.want, v, err)
+		}
+	}
+
+	// the conversions keep the exact arithmetic of EvalRat
+	if r, err := e.EvalRat("to(5 km/h, m/s)", nil); err != nil || r.String() != "25/18 m/s" {
+		t.Errorf("want 25/18 m/s, get %v, %v", r, err)
+	}
+	var ue *UnitError
+	for _, s := range []string{"1 m + 1 s", "sin(1 m)", "to(3 m, s)", "sqrt(2 m)"} {
+		if _, err := e.EvalValue(s, nil); !errors.As(err, &ue) || ue.Code() != CodeUnit {
+			t.Errorf("%s: want a unit error, get %v", s, err)
+		}
+	}
+	// the float64 API has no quantities, the error points at the whole expression
+	var te *TypeError
+	if _, err := e.ParseAndExec("to(5 km/h, m/s)", nil); !errors.As(err, &te) || te.Span != (Span{0, 15}) ||
+		!strings.Contains(te.Error(), "EvalValue") {
+		t.Errorf("want a type error at [0:15], get %v", err)
+	}
+	if r, err := e.ParseAndExec("to(5 km/h, m/s) / (1 m/s)", nil); err != nil || math.Abs(r-25.0/18) > 1e-15 {
+		t.Errorf("want 25/18, get %v, %v", r, err)
+	}
+
+	tex := ExprASTLaTex(parseForTest(t, "to(5 km/h, m/s) + 2 kg*m/s^2"))
+	want := "5\\,\\mathrm{km/h} \\to \\mathrm{m/s} + 2\\,\\mathrm{kg \\cdot m/s^{2}}"
+	if tex != want {
+		t.Errorf("want %q, get %q", want, tex)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	e := NewEngine()
+	params := map[string]Value{"$a": Integer(3), "$b": Number(6), "$s": String("abc"), "$l": List{Integer(1), Integer(2)}}
+	cases := []struct {
+		s    string
+		want Value
+	}{
+		{"$a * 2 >= $b", Bool(true)},
+		{"$a * 2 > $b", Bool(false)},
+		{"1 + 1 == 2", Bool(true)},
+		{"1<=2", Bool(true)},
+		{"2 != 2.0", Bool(false)},
+		{"1 < 2 == 2 < 3", Bool(true)},
+		{"$s == $s", Bool(true)},
+		{"$s < $s", Bool(false)},
+		{"$l == [1, 2]", Bool(true)},
+		{"$l != [1, 3]", Bool(true)},
+		{"1 km > 900 m", Bool(true)},
+	}
+	for _, c := range cases {
+		v, err := e.EvalValue(c.s, params)
+		if err != nil || v != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, v, err)
+		}
+	}
+	if r, err := e.ParseAndExec("$x >= 0.5", map[string]float64{"$x": 1}); err != nil || r != 1 {
+		t.Errorf("want 1, get %v, %v", r, err)
+	}
+	if r, err := e.ParseAndExec("$x == $x", map[string]float64{"$x": math.NaN()}); err != nil || r != 0 {
+		t.Errorf("NaN: want 0, get %v, %v", r, err)
+	}
+	// the float64 API sees the booleans as 1 or 0 like Program and the VM, the typed API does not
+	for s, want := range map[string]float64{"1 == 1 == 1": 1, "1 < 2 < 3": 1, "(1 < 2) + 1": 2} {
+		if r, err := e.ParseAndExec(s, nil); err != nil || r != want {
+			t.Errorf("%s: want %v, get %v, %v", s, want, r, err)
+		}
+	}
+	if _, err := e.EvalValue("(1 < 2) + 1", nil); err == nil {
+		t.Error("want a type error adding a boolean in the typed API")
+	}
+	var te *TypeError
+	if _, err := e.EvalValue("$s < 1", params); !errors.As(err, &te) || te.Op != "<" {
+		t.Errorf("want a type error, get %v", err)
+	}
+	var ue *UnitError
+	if _, err := e.EvalValue("1 m < 1 s", nil); !errors.As(err, &ue) {
+		t.Errorf("want a unit error, get %v", err)
+	}
+	if tex := ExprASTLaTex(parseForTest(t, "$a * 2 >= $b")); tex != "a \\times 2 \\geq b" {
+		t.Errorf("unexpected LaTeX %q", tex)
+	}
+}
+
+func TestLogical(t *testing.T) {
+	e := NewEngine()
+	params := map[string]Value{"$n": Integer(4), "$d": Integer(0), "$t": Bool(true)}
+	cases := []struct {
+		s    string
+		want Value
+	}{
+		{"$d != 0 && $n / $d > 1", Bool(false)},
+		{"$d == 0 || $n / $d > 1", Bool(true)},
+		{"$n > 1 and $n < 5", Bool(true)},
+		{"$n < 1 or not $t", Bool(false)},
+		{"!$t || $n == 4 && $d == 1", Bool(false)},
+		{"!($d != 0)", Bool(true)},
+		{"not(0)", Bool(true)},
+	}
+	for _, c := range cases {
+		v, err := e.EvalValue(c.s, params)
+		if err != nil || v != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, v, err)
+		}
+	}
+
+	// the float64 API, the compiled programs and the bytecode short-circuit too
+	s := "$d != 0 && $n / $d > 1 || !$d"
+	fparams := map[string]float64{"$n": 4, "$d": 0}
+	if r, err := e.ParseAndExec(s, fparams); err != nil || r != 1 {
+		t.Errorf("want 1, get %v, %v", r, err)
+	}
+	p, err := e.Compile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := p.Eval(fparams); err != nil || r != 1 {
+		t.Errorf("program: want 1, get %v, %v", r, err)
+	}
+	b, err := e.CompileBytecode(parseForTest(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := b.MarshalBinary()
+	var loaded Bytecode
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err, "\n", b)
+	}
+	if r, err := NewVM(e).Run(&loaded, fparams); err != nil || r != 1 {
+		t.Errorf("bytecode: want 1, get %v, %v\n%s", r, err, b)
+	}
+
+	if _, err := e.EvalValue("$s && true", map[string]Value{"$s": String("a")}); err == nil {
+		t.Error("want a type error")
+	}
+	if tex := ExprASTLaTex(parseForTest(t, "!$a and $b or $c")); tex != "\\neg a \\land b \\lor c" {
+		t.Errorf("unexpected LaTeX %q", tex)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	e := NewEngine()
+	params := map[string]Value{"$a": Integer(6), "$b": Integer(0)}
+	cases := []struct {
+		s    string
+		want Value
+	}{
+		{"if($b != 0, $a / $b, -1)", Integer(-1)},
+		{"$b != 0 ? $a / $b : 0", Integer(0)},
+		{"$a > 5 ? 1 : $a > 2 ? 2 : 3", Integer(1)},
+		{"$b > 5 ? 1 : $b > 2 ? 2 : 3", Integer(3)},
+		{"1 + ($a > 1 ? 10 : 20)", Integer(11)},
+		{"$a > 1 ? $b == 0 ? 7 : 8 : 9", Integer(7)},
+	}
+	for _, c := range cases {
+		v, err := e.EvalValue(c.s, params)
+		if err != nil || v != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, v, err)
+		}
+	}
+
+	// the branch that is not selected is never evaluated, by the programs and the bytecode neither
+	s := "$b == 0 ? 1 : $a / $b"
+	fparams := map[string]float64{"$a": 6, "$b": 0}
+	p, err := e.Compile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := p.Eval(fparams); err != nil || r != 1 {
+		t.Errorf("program: want 1, get %v, %v", r, err)
+	}
+	b, err := e.CompileBytecode(parseForTest(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := b.MarshalBinary()
+	var loaded Bytecode
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err, "\n", b)
+	}
+	for _, c := range []struct{ b, want float64 }{{0, 1}, {2, 3}} {
+		fparams["$b"] = c.b
+		if r, err := NewVM(e).Run(&loaded, fparams); err != nil || r != c.want {
+			t.Errorf("bytecode: want %v, get %v, %v\n%s", c.want, r, err, b)
+		}
+	}
+
+	if _, err := e.EvalValue("1 ? 2", nil); err == nil {
+		t.Error("want a syntax error without ':'")
+	}
+	want := "\\begin{cases}1 & \\text{if } x > 0 \\\\ 0 & \\text{otherwise}\\end{cases}"
+	if tex := ExprASTLaTex(parseForTest(t, "$x > 0 ? 1 : 0")); tex != want {
+		t.Errorf("want %q, get %q", want, tex)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	cases := []struct {
+		s    string
+		want float64
+	}{
+		{"2^3^2", 512},
+		{"(2^3)^2", 64},
+		{"-2^2", -4},
+		{"(-2)^2", 4},
+		{"2^-2", 0.25},
+		{"2^-1^2", 0.5},
+		{"-2^-2", -0.25},
+		{"-2 * 3", -6},
+		{"-3 + 5", 2},
+		{"2 * -3", -6},
+		{"--2", 2},
+		{"-2^2 + 1", -3},
+		{"10 - 4 - 3", 3},
+		{"64 / 4 / 2", 8},
+		{"2 + 3 * 4 ^ 2", 50},
+		{"7 % 4 * 2", 6},
+		{"-2 < 1", 1},
+		{"2 * -3^2", -18},
+		{"1 - 2 > 0 || 2^2 == 4", 1},
+	}
+	for _, c := range cases {
+		r, err := ParseAndExec(c.s, nil)
+		if err != nil || r != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+	}
+}
+
+func TestPratt(t *testing.T) {
+	e := NewEngine()
+	if err := e.RegConst("origin", 7); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		s    string
+		want float64
+	}{
+		{"+2 * 3", 6},
+		{"-+2", -2},
+		{"2 ^ +2", 4},
+		{"+(1 + 2)", 3},
+		{"origin - 1", 6},
+		{"not 0 ? origin : 0", 7},
+		{"1 + (0 ? 1 : 2) * 3", 7},
+	}
+	for _, c := range cases {
+		r, err := e.ParseAndExec(c.s, nil)
+		if err != nil || r != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+	}
+	if _, err := e.ParseAndExec("2 ? 1", nil); err == nil {
+		t.Error("want an error for a conditional without ':'")
+	}
+}
+
+func TestRegOperator(t *testing.T) {
+	e := NewEngine()
+	regs := []struct {
+		symbol     string
+		kind       OperatorKind
+		precedence int
+		assoc      Associativity
+		eval       func(a, b float64) float64
+	}{
+		{"//", InfixOperator, 40, LeftAssoc, func(a, b float64) float64 { return math.Floor(a / b) }},
+		{"**", InfixOperator, 60, RightAssoc, math.Pow},
+		{"<<", InfixOperator, 18, LeftAssoc, func(a, b float64) float64 { return float64(int64(a) << uint(b)) }},
+		{"xor", InfixOperator, 5, LeftAssoc, func(a, b float64) float64 { return float64(int64(a) ^ int64(b)) }},
+		{"~", PrefixOperator, PrefixPrecedence, LeftAssoc, func(_, b float64) float64 { return -b - 1 }},
+		{"@", PostfixOperator, 70, LeftAssoc, func(a, _ float64) float64 { return a * 2 }},
+	}
+	for _, r := range regs {
+		if err := e.RegOperator(r.symbol, r.kind, r.precedence, r.assoc, r.eval, nil); err != nil {
+			t.Fatal(r.symbol, err)
+		}
+	}
+	cases := []struct {
+		s    string
+		want float64
+	}{
+		{"7 // 2", 3},
+		{"2 ** 3 ** 2", 512},
+		{"1 << 3 + 1", 16},
+		{"1 xor 1 + 1", 3},
+		{"~3", -4},
+		{"~2^2", -5},
+		{"3@ + 1", 7},
+		{"-2@", -4},
+		{"~1 // 2 ** 2", -1},
+	}
+	for _, c := range cases {
+		r, err := e.ParseAndExec(c.s, nil)
+		if err != nil || r != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+		p, err := e.Compile(c.s)
+		if err != nil {
+			t.Fatal(c.s, err)
+		}
+		if r, err := p.Eval(nil); err != nil || r != c.want {
+			t.Errorf("compiled %s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+		expr, _ := e.parseExpr(c.s)
+		b, err := e.CompileBytecode(expr)
+		if err != nil {
+			t.Fatal(c.s, err)
+		}
+		if r, err := NewVM(e).Run(b, nil); err != nil || r != c.want {
+			t.Errorf("bytecode %s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+	}
+	expr, _ := e.parseExpr("~$a xor 7 // 2@")
+	if tex := e.ExprASTLaTex(expr); tex != "~a xor 7 // 2@" {
+		t.Errorf("want the default LaTeX, get %s", tex)
+	}
+	for _, symbol := range []string{"", "+", "(", "]", "?", "//", "sin", "pi", "m", "a b", "1x", "$"} {
+		if err := e.RegOperator(symbol, InfixOperator, 10, LeftAssoc, math.Max, nil); err == nil {
+			t.Errorf("want an error registering %q", symbol)
+		}
+	}
+	// the longest symbol wins, so these would split the existing input differently
+	for _, symbol := range []string{"*-", "^-", "++", "%-", "?-", "!&", "!!!", "-!"} {
+		if err := e.RegOperator(symbol, InfixOperator, 10, LeftAssoc, math.Max, nil); err == nil {
+			t.Errorf("want an error registering %q", symbol)
+		}
+	}
+	for s, want := range map[string]float64{"2*-3": -6, "2^-1": 0.5, "1++2": 3, "3!!!": 6, "2!&&1": 1} {
+		if r, err := e.ParseAndExec(s, nil); err != nil || r != want {
+			t.Errorf("%s: want %v, get %v, %v", s, want, r, err)
+		}
+	}
+	if err := e.RegFunction("xor", 2, nil, nil); err == nil {
+		t.Error("want an error registering a function named like an operator")
+	}
+	if _, err := NewEngine().ParseAndExec("7 // 2", nil); err == nil {
+		t.Error("want the operators to stay in their engine")
+	}
+}
+
+func TestPostfix(t *testing.T) {
+	cases := []struct {
+		s    string
+		want float64
+	}{
+		{"5!", 120},
+		{"0!", 1},
+		{"7!!", 105},
+		{"8!!", 384},
+		{"3!!", 3},
+		{"-3!", -6},
+		{"2^3!", 64},
+		{"3!^2", 36},
+		{"(1 + 2)!", 6},
+		{"5! == 120", 1},
+		{"!!1", 1},
+		{"15%", 0.15},
+		{"(15%) + 1", 1.15},
+		{"15% * 2", 0.3},
+		{"50% * 4", 2},
+		{"15% + 2", 2.15},
+		{"15% - 3", -2.85},
+		{"200 * 15% + 10", 40},
+		{"15 % -3", -2.85},
+		{"15 % abs(4)", 3},
+		{"200 * 5%", 10},
+		{"15 % 4", 3},
+		{"15%4", 3},
+		{"15 % (4)", 3},
+		{"(15%)", 0.15},
+	}
+	for _, c := range cases {
+		r, err := ParseAndExec(c.s, nil)
+		if err != nil || r != c.want {
+			t.Errorf("%s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+		p, err := Compile(c.s)
+		if err != nil {
+			t.Fatal(c.s, err)
+		}
+		if r, err := p.Eval(nil); err != nil || r != c.want {
+			t.Errorf("compiled %s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+		expr, _ := DefaultEngine().parseExpr(c.s)
+		b, err := CompileBytecode(expr)
+		if err != nil {
+			t.Fatal(c.s, err)
+		}
+		if r, err := NewVM(DefaultEngine()).Run(b, nil); err != nil || r != c.want {
+			t.Errorf("bytecode %s: want %v, get %v, %v", c.s, c.want, r, err)
+		}
+	}
+	for _, s := range []string{"2 % 0.5", "10 % 3%"} {
+		var dz *DivisionByZeroError
+		if _, err := ParseAndExec(s, nil); !errors.As(err, &dz) {
+			t.Errorf("%s: want *DivisionByZeroError, get %v", s, err)
+		}
+		p, _ := Compile(s)
+		if _, err := p.Eval(nil); !errors.As(err, &dz) {
+			t.Errorf("compiled %s: want *DivisionByZeroError, get %v", s, err)
+		}
+		expr, _ := DefaultEngine().parseExpr(s)
+		b, _ := CompileBytecode(expr)
+		if _, err := NewVM(DefaultEngine()).Run(b, nil); !errors.As(err, &dz) {
+			t.Errorf("bytecode %s: want *DivisionByZeroError, get %v", s, err)
+		}
+	}
+	if r, _ := ParseAndExec("0.5!", nil); math.Abs(r-math.Sqrt(math.Pi)/2) > 1e-12 {
+		t.Errorf("0.5! want Γ(1.5), get %v", r)
+	}
+	if r, _ := ParseAndExec("(-2)!", nil); !math.IsNaN(r) {
+		t.Errorf("(-2)! want NaN, get %v", r)
+	}
+	if v, err := DefaultEngine().EvalValue("20!", nil); err != nil || v != Integer(2432902008176640000) {
+		t.Errorf("20! want an exact integer, get %v, %v", v, err)
+	}
+	expr, _ := DefaultEngine().parseExpr("(1 + 2)! + 15% * 3!!")
+	if tex := ExprASTLaTex(expr); tex != "\\left(1 + 2\\right)! + 15\\% \\times 3!!" {
+		t.Errorf("unexpected LaTeX %s", tex)
+	}
+}
@@ -0,0 +1,325 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorCode 稳定的错误码，可用于 API 返回与国际化
+type ErrorCode string
+
+const (
+	CodeEmptyExpression   ErrorCode = "empty_expression"
+	CodeUnknownSymbol     ErrorCode = "unknown_symbol"
+	CodeBadNumber         ErrorCode = "bad_number"
+	CodeUnexpectedEOF     ErrorCode = "unexpected_eof"
+	CodeUnexpectedToken   ErrorCode = "unexpected_token"
+	CodeMissingParen      ErrorCode = "missing_paren"
+	CodeUndefinedFunction ErrorCode = "undefined_function"
+	CodeUndefinedConst    ErrorCode = "undefined_const"
+	CodeArity             ErrorCode = "arity"
+	CodeDivisionByZero    ErrorCode = "division_by_zero"
+	CodeType              ErrorCode = "type"
+	CodeUnit              ErrorCode = "unit"
+	CodeEval              ErrorCode = "eval"
+	CodeLimit             ErrorCode = "limit"
+	CodeCanceled          ErrorCode = "canceled"
+)
+
+var (
+	// ErrStepLimit is returned when an evaluation runs out of its step budget
+	ErrStepLimit = errors.New("step limit exceeded")
+	// ErrIterationLimit is returned when the sums of an evaluation run out of their iteration budget
+	ErrIterationLimit = errors.New("iteration limit exceeded")
+	// ErrInexact is returned by EvalRat with Engine.StrictRat when a result can not be exact,
+	// and by EvalBig when a function or an operator has no big.Float version
+	ErrInexact = errors.New("result is not exact")
+	// ErrRatTooLarge is returned by EvalRat when a power would be too large to compute exactly
+	ErrRatTooLarge = errors.New("rational result too large")
+	// ErrBigTooLarge is returned by EvalBig when an argument is too large to compute at the precision asked
+	ErrBigTooLarge = errors.New("big.Float argument too large")
+)
+
+// Error is implemented by every error the engine reports while parsing or evaluating,
+// use errors.As with the concrete types below to inspect the details
+type Error interface {
+	error
+	Code() ErrorCode
+	// Pos returns the source range the error refers to
+	Pos() Span
+}
+
+// SyntaxError 词法或语法错误
+type SyntaxError struct {
+	Span
+	code ErrorCode
+	// Token is the raw text of the offending token, empty at the end of input
+	Token string
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *SyntaxError) msg() string {
+	return e.Msg
+}
+
+func (e *SyntaxError) Code() ErrorCode {
+	return e.code
+}
+
+func newSyntaxError(code ErrorCode, tok *Token, format string, args ...interface{}) *SyntaxError {
+	e := &SyntaxError{code: code, Msg: fmt.Sprintf(format, args...)}
+	if tok != nil {
+		e.Span = Span{tok.Offset, tok.End}
+		e.Token = tok.Value
+	}
+	return e
+}
+
+// UndefinedFunctionError 调用了未注册的函数
+type UndefinedFunctionError struct {
+	Span
+	Name string
+}
+
+func (e *UndefinedFunctionError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *UndefinedFunctionError) msg() string {
+	return fmt.Sprintf("function `%s` is undefined", e.Name)
+}
+
+func (e *UndefinedFunctionError) Code() ErrorCode {
+	return CodeUndefinedFunction
+}
+
+// UndefinedConstError 使用了未注册的常量
+type UndefinedConstError struct {
+	Span
+	Name string
+}
+
+func (e *UndefinedConstError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *UndefinedConstError) msg() string {
+	return fmt.Sprintf("const `%s` is undefined", e.Name)
+}
+
+func (e *UndefinedConstError) Code() ErrorCode {
+	return CodeUndefinedConst
+}
+
+// ArityError 函数参数个数错误
+type ArityError struct {
+	Span
+	Name string
+	Want int
+	Got  int
+	// AtLeast is set when the function is variadic and Want is the minimum
+	AtLeast bool
+}
+
+func (e *ArityError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *ArityError) msg() string {
+	want := fmt.Sprint(e.Want)
+	if e.AtLeast {
+		want = "at least " + want
+	}
+	return fmt.Sprintf("wrong way calling function `%s`, parameters want %s but get %d", e.Name, want, e.Got)
+}
+
+func (e *ArityError) Code() ErrorCode {
+	return CodeArity
+}
+
+func (e *ArityError) locate(span Span) {
+	if e.End == 0 {
+		e.Span = span
+	}
+}
+
+// DivisionByZeroError 除数为零，Span 指向出错的 a/b 子表达式
+type DivisionByZeroError struct {
+	Span
+	Op  string
+	Lhs float64
+	Rhs float64
+}
+
+func (e *DivisionByZeroError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *DivisionByZeroError) msg() string {
+	return fmt.Sprintf("violation of arithmetic specification: a division by zero: [%g%s%g]", e.Lhs, e.Op, e.Rhs)
+}
+
+func (e *DivisionByZeroError) Code() ErrorCode {
+	return CodeDivisionByZero
+}
+
+func (e *DivisionByZeroError) locate(span Span) {
+	if e.End == 0 {
+		e.Span = span
+	}
+}
+
+// TypeError 运算符或函数收到了不支持类型的值
+type TypeError struct {
+	Span
+	// Op is the operator or function, empty if unknown
+	Op   string
+	Want string
+	Got  Kind
+}
+
+func (e *TypeError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *TypeError) msg() string {
+	if e.Op == "" {
+		return fmt.Sprintf("type error: want %s but get %s", e.Want, e.Got)
+	}
+	return fmt.Sprintf("type error: `%s` wants %s but get %s", e.Op, e.Want, e.Got)
+}
+
+func (e *TypeError) Code() ErrorCode {
+	return CodeType
+}
+
+func (e *TypeError) locate(span Span) {
+	if e.End == 0 {
+		e.Span = span
+	}
+}
+
+// UnitError 量纲不一致，例如 1 m + 1 s
+type UnitError struct {
+	Span
+	// Op is the operator or function
+	Op   string
+	Want string
+	Got  Unit
+}
+
+func (e *UnitError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *UnitError) msg() string {
+	return fmt.Sprintf("unit error: `%s` wants %s but get %s", e.Op, e.Want, e.Got)
+}
+
+func (e *UnitError) Code() ErrorCode {
+	return CodeUnit
+}
+
+func (e *UnitError) locate(span Span) {
+	if e.End == 0 {
+		e.Span = span
+	}
+}
+
+// LimitError 表达式超出了 Limits 中的某项限制
+type LimitError struct {
+	Span
+	// Limit is the name of the exceeded field of Limits
+	Limit string
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *LimitError) msg() string {
+	return fmt.Sprintf("expression exceeds the limit %s of %d", e.Limit, e.Max)
+}
+
+func (e *LimitError) Code() ErrorCode {
+	return CodeLimit
+}
+
+// EvalError 其他求值错误，例如自定义函数中的 panic
+// Span is the source range of the innermost sub-expression that failed
+type EvalError struct {
+	Span
+	Err error
+}
+
+func (e *EvalError) Error() string {
+	return withPos(e.msg(), e.Span)
+}
+
+func (e *EvalError) msg() string {
+	return e.Err.Error()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+func (e *EvalError) Code() ErrorCode {
+	switch {
+	case errors.Is(e.Err, ErrStepLimit), errors.Is(e.Err, ErrIterationLimit), errors.Is(e.Err, ErrRatTooLarge),
+		errors.Is(e.Err, ErrBigTooLarge):
+		return CodeLimit
+	case errors.Is(e.Err, context.Canceled), errors.Is(e.Err, context.DeadlineExceeded):
+		return CodeCanceled
+	}
+	return CodeEval
+}
+
+func withPos(msg string, span Span) string {
+	return fmt.Sprintf("%s, pos [%d:%d]", msg, span.Start, span.End)
+}
+
+// locatable runtime errors raised without a position get the span of the node that raised them
+type locatable interface {
+	error
+	locate(span Span)
+}
+
+// locate is deferred around the evaluation of a node,
+// a panic raised while evaluating it is re-raised as an Error pointing at span.
+// errors already located by a sub-expression keep their more precise span
+func locate(span Span) {
+	if rec := recover(); rec != nil {
+		panic(located(rec, span))
+	}
+}
+
+func located(rec interface{}, span Span) error {
+	switch err := rec.(type) {
+	case locatable:
+		err.locate(span)
+		return err
+	case Error:
+		return err
+	case error:
+		return &EvalError{Span: span, Err: err}
+	default:
+		return &EvalError{Span: span, Err: fmt.Errorf("%v", rec)}
+	}
+}
+
+// FormatError render err with a marker under the offending position of source,
+// errors not produced by the engine are returned as is
+func FormatError(err error, source string) string {
+	var e Error
+	if !errors.As(err, &e) {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s\n%s", err.Error(), ErrPos(source, e.Pos().Start))
+}
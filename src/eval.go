@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ctxCheckInterval is the number of steps between two checks of the context
+const ctxCheckInterval = 256
+
+// evaluator 单次求值的状态
+// it is created for every evaluation and never shared between goroutines
+type evaluator struct {
+	e      *Engine
+	ctx    context.Context
+	limits Limits
+	steps  int
+	iters  float64
+	// undefined is the value of the variables missing from params
+	undefined Value
+	// mode builds literals and constants, nil for Integer and Number
+	mode numberMode
+	// strict forbids the numeric kinds to fall back to float64, see Engine.StrictRat
+	strict bool
+	// floats is set for the float64 API, the booleans are 1 or 0 there like in Program and the VM
+	floats bool
+}
+
+// numberMode 求值模式，决定字面量与常量的数值类型
+type numberMode interface {
+	literal(n NumberExprNode) Value
+	constant(n ConstExprNode) Value
+}
+
+func (e *Engine) newEvaluator(ctx context.Context, undefined Value) *evaluator {
+	return &evaluator{e: e, ctx: ctx, limits: e.Limits, undefined: undefined}
+}
+
+// newFloatEvaluator create the evaluator of the float64 API: missing variables are 0 and booleans are numbers
+func (e *Engine) newFloatEvaluator(ctx context.Context) *evaluator {
+	ev := e.newEvaluator(ctx, Number(0))
+	ev.floats = true
+	return ev
+}
+
+func (ev *evaluator) eval(expr ExprNode, params map[string]Value) Value {
+	ev.step()
+	var l, r Value
+	switch expr.(type) {
+	case OperatorExprNode:
+		ast := expr.(OperatorExprNode)
+		op, _ := ev.e.lookupOperator(ast.Op)
+		if lazy, ok := op.(LazyOperator); ok {
+			defer locate(ast.Span)
+			return ev.boolean(lazy.LazyResultValue(
+				func() Value { return ev.eval(ast.Lhs, params) },
+				func() Value { return ev.eval(ast.Rhs, params) },
+			))
+		}
+		l = ev.eval(ast.Lhs, params)
+		r = ev.eval(ast.Rhs, params)
+		defer locate(ast.Span)
+		return ev.boolean(ev.applyOperator(op, l, r))
+	case NumberExprNode:
+		if ev.mode != nil {
+			return ev.mode.literal(expr.(NumberExprNode))
+		}
+		return literal(expr.(NumberExprNode))
+	case ConstExprNode:
+		if ev.mode != nil {
+			return ev.mode.constant(expr.(ConstExprNode))
+		}
+		return Number(expr.(ConstExprNode).Val)
+	case VariableExprNode:
+		val := expr.(VariableExprNode).Val
+		if v, ok := params[val]; ok {
+			return v
+		}
+		return ev.undefined
+	case ListExprNode:
+		items := expr.(ListExprNode).Items
+		l := make(List, len(items))
+		for i, item := range items {
+			l[i] = ev.eval(item, params)
+		}
+		return l
+	case QuantityExprNode:
+		q := expr.(QuantityExprNode)
+		val := q.Val
+		if val == nil {
+			val = NumberExprNode{Span: q.Span, Val: 1, Str: "1"}
+		}
+		return Quantity{Val: ev.eval(val, params), Unit: q.Unit}
+	case FunCallerExprNode:
+		f := expr.(FunCallerExprNode)
+		def, _ := ev.e.lookupFunc(f.Name)
+		defer locate(f.Span)
+		return ev.boolean(def.fun(ev, params, f.Arg...))
+	case ResultNode:
+		return Number(expr.(ResultNode).Result(ev.e, floatParams(params)))
+	}
+
+	return Number(0)
+}
+
+// boolean returns v, a boolean is converted to 1 or 0 in the float64 API
+// so 1 < 2 < 3 and (1 < 2) + 1 evaluate the same way as in Program and the VM
+func (ev *evaluator) boolean(v Value) Value {
+	if b, ok := v.(Bool); ok && ev.floats {
+		return Integer(resultFloat(b))
+	}
+	return v
+}
+
+// float evaluate expr into a number, panics with a *TypeError pointing at expr otherwise
+func (ev *evaluator) float(expr ExprNode, params map[string]Value) float64 {
+	return numberOf(ev.eval(expr, params), expr)
+}
+
+// numberOf returns v as float64, panics with a *TypeError pointing at the expression v comes from otherwise
+func numberOf(v Value, expr ExprNode) float64 {
+	f, ok := toFloat(v)
+	if !ok {
+		panic(&TypeError{Span: expr.Pos(), Want: "number", Got: v.Kind()})
+	}
+	return f
+}
+
+// math1 evaluate a builtin function of one number, the numeric kinds provide their own version
+// and fall back to f on float64 when they do not
+func (ev *evaluator) math1(name string, f func(float64) float64, expr ExprNode, params map[string]Value) Value {
+	return ev.apply(name, f, ev.eval(expr, params), expr)
+}
+
+// trig same as math1, the argument is converted to radian in AngleMode
+func (ev *evaluator) trig(name string, f func(float64) float64, expr ExprNode, params map[string]Value) Value {
+	v := ev.eval(expr, params)
+	if ev.e.trigonometricMode() == AngleMode {
+		v = ev.apply("rad", rad, v, expr)
+	}
+	return ev.apply(name, f, v, expr)
+}
+
+func (ev *evaluator) apply(name string, f func(float64) float64, v Value, expr ExprNode) Value {
+	if q, ok := v.(Quantity); ok {
+		return ev.quantityCall(name, f, q, expr)
+	}
+	if n, ok := v.(numeric); ok {
+		if r, ok := n.call(name); ok {
+			return r
+		}
+		ev.inexact(name, n)
+		if _, ok := n.(Interval); ok {
+			// the float64 result of a degenerate interval is widened to still enclose the exact one
+			r := f(numberOf(v, expr))
+			return widen(r, r)
+		}
+	}
+	return Number(f(numberOf(v, expr)))
+}
+
+// inexact is called before a numeric kind falls back to float64, in strict mode it is an error instead
+func (ev *evaluator) inexact(name string, n numeric) {
+	if ev.strict {
+		panic(fmt.Errorf("%w: `%s` of %s", ErrInexact, name, n.Kind()))
+	}
+}
+
+// step account for one unit of work, panics when the step budget is exhausted or the context is done
+func (ev *evaluator) step() {
+	ev.steps++
+	if ev.limits.MaxSteps > 0 && ev.steps > ev.limits.MaxSteps {
+		panic(ErrStepLimit)
+	}
+	if ev.ctx != nil && ev.steps%ctxCheckInterval == 0 {
+		if err := ev.ctx.Err(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// iterate reserve n loop iterations, panics if they exceed the iteration budget
+func (ev *evaluator) iterate(n float64) {
+	ev.iters += n
+	if ev.limits.MaxIterations > 0 && ev.iters > float64(ev.limits.MaxIterations) {
+		panic(ErrIterationLimit)
+	}
+}
+
+// loopCount returns the number of iterations of `for i := from; i <= to; i++`
+func loopCount(from, to float64) float64 {
+	if !(to >= from) {
+		return 0
+	}
+	return math.Floor(to-from) + 1
+}
+
+// aborted reports whether rec stops the whole evaluation,
+// noerr must not swallow an exhausted budget or a cancellation
+func aborted(rec interface{}) bool {
+	err, ok := rec.(error)
+	if !ok {
+		return false
+	}
+	return errors.Is(err, ErrStepLimit) || errors.Is(err, ErrIterationLimit) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
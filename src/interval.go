@@ -0,0 +1,519 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Interval 区间 [Lo, Hi]，EvalInterval 的结果包含变量取遍各自区间时表达式的所有值
+type Interval struct {
+	Lo float64
+	Hi float64
+}
+
+// entire is the result when nothing better than the whole real line can be said
+var entire = Interval{math.Inf(-1), math.Inf(1)}
+
+func (x Interval) Kind() Kind {
+	return IntervalKind
+}
+
+func (x Interval) String() string {
+	return fmt.Sprintf("[%s, %s]", Float64ToStr(x.Lo), Float64ToStr(x.Hi))
+}
+
+// Contains reports whether f is inside x
+func (x Interval) Contains(f float64) bool {
+	return x.Lo <= f && f <= x.Hi
+}
+
+func (x Interval) rank() int {
+	return rankInterval
+}
+
+// float returns the value of a degenerate interval
+func (x Interval) float() (float64, bool) {
+	return x.Lo, x.Lo == x.Hi
+}
+
+// toInterval convert a number of a lower rank into a degenerate interval
+func toInterval(v Value) Interval {
+	if x, ok := v.(Interval); ok {
+		return x
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		panic(&TypeError{Want: "a real number", Got: v.Kind()})
+	}
+	return Interval{f, f}
+}
+
+// down and up round the result r of an operation outward, err is the sign of the exact result minus r
+func down(r float64, err float64) float64 {
+	if err < 0 || math.IsInf(r, 1) {
+		return math.Nextafter(r, math.Inf(-1))
+	}
+	return r
+}
+
+func up(r float64, err float64) float64 {
+	if err > 0 || math.IsInf(r, -1) {
+		return math.Nextafter(r, math.Inf(1))
+	}
+	return r
+}
+
+// addErr returns a + b and the rounding error of the sum (TwoSum)
+func addErr(a, b float64) (float64, float64) {
+	s := a + b
+	if math.IsInf(s, 0) {
+		return s, 0
+	}
+	bb := s - a
+	return s, (a - (s - bb)) + (b - bb)
+}
+
+// mulErr returns a * b and the rounding error of the product, 0·Inf is 0 on intervals
+func mulErr(a, b float64) (float64, float64) {
+	if a == 0 || b == 0 {
+		return 0, 0
+	}
+	p := a * b
+	if math.IsInf(p, 0) {
+		return p, 0
+	}
+	return p, math.FMA(a, b, -p)
+}
+
+// quoErr returns a / b and the sign of the rounding error of the quotient
+func quoErr(a, b float64) (float64, float64) {
+	if a == 0 {
+		return 0, 0
+	}
+	q := a / b
+	if math.IsInf(q, 0) || math.IsInf(b, 0) {
+		return q, 0
+	}
+	// a/b = q - r/b
+	r := math.FMA(q, b, -a)
+	return q, -r * b
+}
+
+// widen round the result of a math function outward by one ulp, they are not correctly rounded
+func widen(lo, hi float64) Interval {
+	return Interval{math.Nextafter(lo, math.Inf(-1)), math.Nextafter(hi, math.Inf(1))}
+}
+
+func (x Interval) add(y Interval) Interval {
+	lo, el := addErr(x.Lo, y.Lo)
+	hi, eh := addErr(x.Hi, y.Hi)
+	return Interval{down(lo, el), up(hi, eh)}
+}
+
+func (x Interval) neg() Interval {
+	return Interval{-x.Hi, -x.Lo}
+}
+
+func (x Interval) mul(y Interval) Interval {
+	r := Interval{math.Inf(1), math.Inf(-1)}
+	for _, a := range [2]float64{x.Lo, x.Hi} {
+		for _, b := range [2]float64{y.Lo, y.Hi} {
+			p, e := mulErr(a, b)
+			r.Lo = math.Min(r.Lo, down(p, e))
+			r.Hi = math.Max(r.Hi, up(p, e))
+		}
+	}
+	return r
+}
+
+// recip 1/x, the result is a half line when x touches zero and the whole line when zero is inside
+func (x Interval) recip() Interval {
+	switch {
+	case x.Lo == 0 && x.Hi == 0:
+		panic(&DivisionByZeroError{Op: "/", Lhs: 1, Rhs: 0})
+	case x.Lo > 0 || x.Hi < 0:
+		lo, el := quoErr(1, x.Hi)
+		hi, eh := quoErr(1, x.Lo)
+		return Interval{down(lo, el), up(hi, eh)}
+	case x.Lo == 0:
+		lo, el := quoErr(1, x.Hi)
+		return Interval{down(lo, el), math.Inf(1)}
+	case x.Hi == 0:
+		hi, eh := quoErr(1, x.Lo)
+		return Interval{math.Inf(-1), up(hi, eh)}
+	}
+	return entire
+}
+
+func (x Interval) quo(y Interval) Interval {
+	if y.Lo == 0 && y.Hi == 0 {
+		panic(&DivisionByZeroError{Op: "/", Lhs: x.Lo, Rhs: 0})
+	}
+	if y.Lo > 0 || y.Hi < 0 {
+		r := Interval{math.Inf(1), math.Inf(-1)}
+		for _, a := range [2]float64{x.Lo, x.Hi} {
+			for _, b := range [2]float64{y.Lo, y.Hi} {
+				q, e := quoErr(a, b)
+				r.Lo = math.Min(r.Lo, down(q, e))
+				r.Hi = math.Max(r.Hi, up(q, e))
+			}
+		}
+		return r
+	}
+	return x.mul(y.recip())
+}
+
+// powInt x^n, the even powers are not monotonic around zero
+func (x Interval) powInt(n int64) Interval {
+	if n < 0 {
+		return x.powInt(-n).recip()
+	}
+	if n == 0 {
+		return Interval{1, 1}
+	}
+	lo, hi := math.Abs(x.Lo), math.Abs(x.Hi)
+	if n%2 == 1 {
+		lo, hi = x.Lo, x.Hi
+	} else if x.Hi < 0 {
+		lo, hi = hi, lo
+	} else if x.Lo <= 0 {
+		lo, hi = 0, math.Max(lo, hi)
+	}
+	l, _ := powBounds(lo, n)
+	_, h := powBounds(hi, n)
+	return Interval{l, h}
+}
+
+// powBounds returns a^n rounded down and up, small powers are multiplied so that exact results stay exact
+func powBounds(a float64, n int64) (float64, float64) {
+	if n > 64 {
+		p := math.Pow(a, float64(n))
+		return math.Nextafter(p, math.Inf(-1)), math.Nextafter(p, math.Inf(1))
+	}
+	lo, hi := 1.0, 1.0
+	abs := math.Abs(a)
+	for i := int64(0); i < n; i++ {
+		p, e := mulErr(lo, abs)
+		lo = down(p, e)
+		p, e = mulErr(hi, abs)
+		hi = up(p, e)
+	}
+	if a < 0 && n%2 == 1 {
+		return -hi, -lo
+	}
+	return lo, hi
+}
+
+func (x Interval) pow(y Interval) Interval {
+	if y.Lo == y.Hi && y.Lo == math.Trunc(y.Lo) && math.Abs(y.Lo) <= 1<<53 {
+		return x.powInt(int64(y.Lo))
+	}
+	if x.Hi < 0 {
+		panic(errors.New("fractional power of negative numbers is not a real number"))
+	}
+	// x^y is monotonic in both arguments for x >= 0, the bounds are reached at the corners
+	x.Lo = math.Max(x.Lo, 0)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, a := range [2]float64{x.Lo, x.Hi} {
+		for _, b := range [2]float64{y.Lo, y.Hi} {
+			p := math.Pow(a, b)
+			lo, hi = math.Min(lo, p), math.Max(hi, p)
+		}
+	}
+	r := widen(lo, hi)
+	r.Lo = math.Max(r.Lo, 0)
+	return r
+}
+
+func (x Interval) binary(op string, a, b Value) (Value, bool) {
+	l, r := toInterval(a), toInterval(b)
+	switch op {
+	case "+":
+		return l.add(r), true
+	case "-":
+		return l.add(r.neg()), true
+	case "*":
+		return l.mul(r), true
+	case "/":
+		return l.quo(r), true
+	case "^":
+		return l.pow(r), true
+	case "%":
+		return l.mod(r), true
+	case "max":
+		return Interval{math.Max(l.Lo, r.Lo), math.Max(l.Hi, r.Hi)}, true
+	case "min":
+		return Interval{math.Min(l.Lo, r.Lo), math.Min(l.Hi, r.Hi)}, true
+	}
+	return nil, false
+}
+
+// mod the remainder of the truncated operands like the float64 version, it has the sign of x.
+// the truncated bounds are integers so the bounds of the result are exact
+func (x Interval) mod(y Interval) Interval {
+	a := Interval{math.Trunc(x.Lo), math.Trunc(x.Hi)}
+	b := Interval{math.Trunc(y.Lo), math.Trunc(y.Hi)}
+	if b.Lo == 0 && b.Hi == 0 {
+		panic(&DivisionByZeroError{Op: "%", Lhs: x.Lo, Rhs: 0})
+	}
+	if b.Lo == b.Hi && !math.IsInf(a.Lo, 0) && !math.IsInf(a.Hi, 0) && !math.IsInf(b.Lo, 0) {
+		// the remainder grows with x as long as the quotient does not change
+		lo, hi := math.Mod(a.Lo, b.Lo), math.Mod(a.Hi, b.Lo)
+		if (a.Lo-lo)/b.Lo == (a.Hi-hi)/b.Lo {
+			return Interval{lo, hi}
+		}
+	}
+	// |x % y| < |y| and |x % y| <= |x|, a zero divisor inside y is left out like the pole of 1/x
+	m := math.Max(math.Abs(b.Lo), math.Abs(b.Hi)) - 1
+	r := Interval{math.Max(a.Lo, -m), math.Min(a.Hi, m)}
+	if a.Lo >= 0 {
+		r.Lo = 0
+	}
+	if a.Hi <= 0 {
+		r.Hi = 0
+	}
+	return r
+}
+
+// cmp intervals are ordered only when they do not overlap
+func (x Interval) cmp(a, b Value) (int, bool) {
+	l, r := toInterval(a), toInterval(b)
+	switch {
+	case l.Hi < r.Lo:
+		return -1, true
+	case l.Lo > r.Hi:
+		return 1, true
+	case l == r && l.Lo == l.Hi:
+		return 0, true
+	}
+	return 0, false
+}
+
+// monotonic apply an increasing function to the bounds
+func (x Interval) monotonic(f func(float64) float64) Interval {
+	return widen(f(x.Lo), f(x.Hi))
+}
+
+// domain restrict x to [lo, +Inf), the function name is not defined on x otherwise
+func (x Interval) domain(name string, lo float64) Interval {
+	if x.Hi < lo {
+		panic(fmt.Errorf("`%s` is not defined on %s", name, x))
+	}
+	x.Lo = math.Max(x.Lo, lo)
+	return x
+}
+
+// hasPoint reports whether x contains offset + k·period for some integer k,
+// it errs on the side of yes so that the result still encloses the exact one
+func (x Interval) hasPoint(offset, period float64) bool {
+	k := math.Ceil((x.Lo-offset)/period - 1e-9)
+	return offset+k*period <= x.Hi+1e-9*math.Max(1, math.Abs(x.Hi))
+}
+
+func (x Interval) cos() Interval {
+	if x.Hi-x.Lo >= 2*math.Pi || math.IsInf(x.Lo, 0) || math.IsInf(x.Hi, 0) {
+		return Interval{-1, 1}
+	}
+	a, b := math.Cos(x.Lo), math.Cos(x.Hi)
+	r := widen(math.Min(a, b), math.Max(a, b))
+	if x.hasPoint(0, 2*math.Pi) {
+		r.Hi = 1
+	}
+	if x.hasPoint(math.Pi, 2*math.Pi) {
+		r.Lo = -1
+	}
+	return Interval{math.Max(r.Lo, -1), math.Min(r.Hi, 1)}
+}
+
+func (x Interval) sin() Interval {
+	if x.Hi-x.Lo >= 2*math.Pi || math.IsInf(x.Lo, 0) || math.IsInf(x.Hi, 0) {
+		return Interval{-1, 1}
+	}
+	a, b := math.Sin(x.Lo), math.Sin(x.Hi)
+	r := widen(math.Min(a, b), math.Max(a, b))
+	if x.hasPoint(math.Pi/2, 2*math.Pi) {
+		r.Hi = 1
+	}
+	if x.hasPoint(-math.Pi/2, 2*math.Pi) {
+		r.Lo = -1
+	}
+	return Interval{math.Max(r.Lo, -1), math.Min(r.Hi, 1)}
+}
+
+// tan is increasing between its poles at pi/2 + k·pi
+func (x Interval) tan() Interval {
+	if x.Hi-x.Lo >= math.Pi || x.hasPoint(math.Pi/2, math.Pi) {
+		return entire
+	}
+	return x.monotonic(math.Tan)
+}
+
+// cot is decreasing between its poles at k·pi
+func (x Interval) cot() Interval {
+	if x.Hi-x.Lo >= math.Pi || x.hasPoint(0, math.Pi) {
+		return entire
+	}
+	return widen(cot(x.Hi), cot(x.Lo))
+}
+
+func (x Interval) call(name string) (Value, bool) {
+	switch name {
+	case "abs":
+		switch {
+		case x.Lo >= 0:
+			return x, true
+		case x.Hi <= 0:
+			return x.neg(), true
+		}
+		return Interval{0, math.Max(-x.Lo, x.Hi)}, true
+	case "ceil":
+		return Interval{math.Ceil(x.Lo), math.Ceil(x.Hi)}, true
+	case "floor":
+		return Interval{math.Floor(x.Lo), math.Floor(x.Hi)}, true
+	case "round":
+		return Interval{math.Round(x.Lo), math.Round(x.Hi)}, true
+	case "sqrt":
+		x = x.domain(name, 0)
+		r := x.monotonic(math.Sqrt)
+		r.Lo = math.Max(r.Lo, 0)
+		return r, true
+	case "cbrt":
+		return x.monotonic(math.Cbrt), true
+	case "ln":
+		return x.domain(name, 0).monotonic(math.Log), true
+	case "lg":
+		return x.domain(name, 0).monotonic(math.Log10), true
+	case "rad":
+		return x.mul(widen(math.Pi/180, math.Pi/180)), true
+	case "sin":
+		return x.sin(), true
+	case "cos":
+		return x.cos(), true
+	case "tan":
+		return x.tan(), true
+	case "cot":
+		return x.cot(), true
+	case "sec":
+		return x.cos().recip(), true
+	case "csc":
+		return x.sin().recip(), true
+	case "factorial":
+		return x.factorial(), true
+	case "doublefactorial":
+		return x.doubleFactorial(), true
+	}
+	return nil, false
+}
+
+// the minimum of Γ(x+1) on (-1, +Inf) is gammaMinY at gammaMinX
+const (
+	gammaMinX = 0.46163214496836234
+	gammaMinY = 0.8856031944108887
+)
+
+// factorial Γ(x+1) decreases down to its minimum and increases after it on (-1, +Inf),
+// further left the poles at the negative integers give the whole line
+func (x Interval) factorial() Interval {
+	if x.Lo > -1 {
+		lo, hi := factorialEnclosure(x.Lo), factorialEnclosure(x.Hi)
+		switch {
+		case x.Lo >= gammaMinX:
+			return Interval{lo.Lo, hi.Hi}
+		case x.Hi <= gammaMinX:
+			return Interval{hi.Lo, lo.Hi}
+		}
+		return Interval{math.Nextafter(gammaMinY, 0), math.Max(lo.Hi, hi.Hi)}
+	}
+	if x.Lo != x.Hi {
+		return entire
+	}
+	if x.Lo == math.Trunc(x.Lo) {
+		panic(fmt.Errorf("`factorial` is not defined on %s", x))
+	}
+	return factorialEnclosure(x.Lo)
+}
+
+// factorialEnclosure returns an interval around f!, the small integers have an exact one
+func factorialEnclosure(f float64) Interval {
+	r := factorial(f)
+	if f == math.Trunc(f) && f <= maxIntFactorial {
+		return Interval{r, r}
+	}
+	return widen(r, r)
+}
+
+// doubleFactorial x!! is defined on the integers from -1 where it does not decrease,
+// the products are rounded outward
+func (x Interval) doubleFactorial() Interval {
+	lo, hi := math.Ceil(math.Max(x.Lo, -1)), math.Floor(x.Hi)
+	if lo > hi {
+		panic(fmt.Errorf("`doublefactorial` is not defined on %s", x))
+	}
+	product := func(n float64) Interval {
+		r := Interval{1, 1}
+		for ; n > 1 && !math.IsInf(r.Lo, 1); n -= 2 {
+			r = r.mul(Interval{n, n})
+		}
+		return r
+	}
+	return Interval{product(lo).Lo, product(hi).Hi}
+}
+
+// intervalMode evaluate literals and constants as intervals enclosing their exact value
+type intervalMode struct{}
+
+// literal a decimal literal such as 0.1 has no exact float64, the interval spans the two nearest ones
+func (intervalMode) literal(n NumberExprNode) Value {
+	exact, ok := new(big.Rat).SetString(n.Str)
+	if !ok || math.IsInf(n.Val, 0) {
+		return Interval{n.Val, n.Val}
+	}
+	switch exact.Cmp(new(big.Rat).SetFloat64(n.Val)) {
+	case -1:
+		return Interval{math.Nextafter(n.Val, math.Inf(-1)), n.Val}
+	case 1:
+		return Interval{n.Val, math.Nextafter(n.Val, math.Inf(1))}
+	}
+	return Interval{n.Val, n.Val}
+}
+
+// constant pi and e are irrational, the other constants are taken as exact
+func (intervalMode) constant(n ConstExprNode) Value {
+	if n.Name == "pi" || n.Name == "e" {
+		return widen(n.Val, n.Val)
+	}
+	return Interval{n.Val, n.Val}
+}
+
+// EvalInterval parse s and evaluate it with interval arithmetic,
+// the result encloses every value of s when each variable ranges over its interval.
+// the bounds are rounded outward, division by an interval containing zero and the poles of tan
+// give half or whole lines, sqrt and the logarithms are restricted to their domain
+func (e *Engine) EvalInterval(s string, params map[string]Interval) (r Interval, err error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return Interval{}, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	values := make(map[string]Value, len(params))
+	for k, v := range params {
+		if !(v.Lo <= v.Hi) {
+			return Interval{}, fmt.Errorf("EvalInterval: %s is not a valid interval for %s", v, k)
+		}
+		values[k] = v
+	}
+	ev := e.newEvaluator(nil, Integer(0))
+	ev.mode = intervalMode{}
+	v := ev.eval(ar, values)
+	if _, ok := v.(Bool); ok {
+		f := resultFloat(v)
+		return Interval{f, f}, nil
+	}
+	return toInterval(v), nil
+}
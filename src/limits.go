@@ -0,0 +1,27 @@
+package engine
+
+// Limits 解析与求值的限制，用于处理不可信的表达式
+// a field set to 0 means unlimited
+type Limits struct {
+	// MaxLength limit the length of the source in bytes
+	MaxLength int
+	// MaxTokens limit the number of tokens of the source
+	MaxTokens int
+	// MaxDepth limit the height of the expression tree:
+	// the nesting of parentheses, function calls and unary operators and the length of the chains of binary operators
+	MaxDepth int
+	// MaxArgs limit the number of arguments of a function call
+	MaxArgs int
+	// MaxSteps limit the number of nodes visited and loop iterations run by one evaluation
+	MaxSteps int
+	// MaxIterations limit the total number of sum iterations of one evaluation,
+	// a sum is rejected before it starts if its range does not fit in the budget left
+	MaxIterations int
+}
+
+// DefaultLimits are the limits of a new Engine,
+// only the height of the tree is bounded so a deeply nested input or a very long chain such as 1+1+...+1
+// fails with an error instead of a stack overflow
+var DefaultLimits = Limits{
+	MaxDepth: 1000,
+}
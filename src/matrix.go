@@ -0,0 +1,416 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"strings"
+)
+
+// 向量与矩阵
+// a vector is a List of numbers, a matrix is a List of rows of the same length.
+// the items may be of any numeric kind, they are combined with the same operators as scalars
+
+func isList(v Value) bool {
+	_, ok := v.(List)
+	return ok
+}
+
+// shape returns the rows and columns of a matrix, ok is false if l is not one
+func shape(l List) (rows int, cols int, ok bool) {
+	if len(l) == 0 {
+		return 0, 0, false
+	}
+	for i, item := range l {
+		row, isRow := item.(List)
+		if !isRow || i > 0 && len(row) != cols {
+			return 0, 0, false
+		}
+		cols = len(row)
+	}
+	return len(l), cols, true
+}
+
+// matrixOf returns v as a matrix, panics with a *TypeError otherwise
+func matrixOf(name string, v Value) (List, int, int) {
+	l, ok := v.(List)
+	if ok {
+		if rows, cols, ok := shape(l); ok {
+			return l, rows, cols
+		}
+	}
+	panic(&TypeError{Op: name, Want: "a matrix", Got: v.Kind()})
+}
+
+// vectorOf returns v as a vector of n items, any length if n < 0
+func vectorOf(name string, v Value, n int) List {
+	l, ok := v.(List)
+	if !ok || n >= 0 && len(l) != n {
+		want := "a vector"
+		if n >= 0 {
+			want = fmt.Sprintf("a vector of %d items", n)
+		}
+		panic(&TypeError{Op: name, Want: want, Got: v.Kind()})
+	}
+	return l
+}
+
+func (ev *evaluator) op(name string, a, b Value) Value {
+	return ev.applyOperator(operators[name], a, b)
+}
+
+// listOperator `*` is the matrix product when a matrix is involved, the other operators work item by item.
+// a scalar operand is applied to every item, a matrix to an integer power is a repeated product
+func (ev *evaluator) listOperator(op OperatorUnit, a, b Value) Value {
+	name := op.Name()
+	l, lok := a.(List)
+	r, rok := b.(List)
+	if name == "*" && lok && rok {
+		_, _, lm := shape(l)
+		_, _, rm := shape(r)
+		switch {
+		case lm && rm:
+			return ev.matMul(l, r)
+		case lm:
+			return ev.matVec(l, r)
+		case rm:
+			return ev.vecMat(l, r)
+		}
+	}
+	if name == "^" && lok && !rok {
+		if _, _, ok := shape(l); ok {
+			return ev.matPow(l, b)
+		}
+	}
+	switch {
+	case lok && rok:
+		if len(l) != len(r) {
+			panic(&TypeError{Op: name, Want: fmt.Sprintf("a list of %d items", len(l)), Got: ListKind})
+		}
+		z := make(List, len(l))
+		for i := range l {
+			z[i] = ev.applyOperator(op, l[i], r[i])
+		}
+		return z
+	case lok:
+		z := make(List, len(l))
+		for i := range l {
+			z[i] = ev.applyOperator(op, l[i], b)
+		}
+		return z
+	default:
+		z := make(List, len(r))
+		for i := range r {
+			z[i] = ev.applyOperator(op, a, r[i])
+		}
+		return z
+	}
+}
+
+// sumOf returns the sum of items, Integer(0) if there is none
+func (ev *evaluator) sumOf(items ...Value) Value {
+	var s Value = Integer(0)
+	for i, item := range items {
+		if i == 0 {
+			s = item
+			continue
+		}
+		s = ev.op("+", s, item)
+	}
+	return s
+}
+
+func (ev *evaluator) dot(a, b List) Value {
+	products := make([]Value, len(a))
+	for i := range a {
+		products[i] = ev.op("*", a[i], b[i])
+	}
+	return ev.sumOf(products...)
+}
+
+func (ev *evaluator) matMul(a, b List) List {
+	_, n, _ := shape(a)
+	rows, _, _ := shape(b)
+	if n != rows {
+		panic(&TypeError{Op: "*", Want: fmt.Sprintf("a matrix of %d rows", n), Got: ListKind})
+	}
+	bt := transpose(b)
+	z := make(List, len(a))
+	for i, row := range a {
+		zr := make(List, len(bt))
+		for j, col := range bt {
+			zr[j] = ev.dot(row.(List), col.(List))
+		}
+		z[i] = zr
+	}
+	return z
+}
+
+func (ev *evaluator) matVec(m, v List) List {
+	_, n, _ := shape(m)
+	vectorOf("*", v, n)
+	z := make(List, len(m))
+	for i, row := range m {
+		z[i] = ev.dot(row.(List), v)
+	}
+	return z
+}
+
+func (ev *evaluator) vecMat(v, m List) List {
+	vectorOf("*", v, len(m))
+	return ev.matVec(transpose(m), v)
+}
+
+// maxMatPow bounds the exponent of a matrix power, every integer up to it is exact in float64
+const maxMatPow = 1 << 53
+
+// matPow m^n by squaring, negative powers use the inverse.
+// every product is a step of Limits.MaxSteps
+func (ev *evaluator) matPow(m List, e Value) List {
+	rows, cols, _ := shape(m)
+	f, ok := toFloat(e)
+	if !ok || f != math.Trunc(f) || math.IsInf(f, 0) || rows != cols {
+		panic(&TypeError{Op: "^", Want: "a square matrix to an integer power", Got: e.Kind()})
+	}
+	if math.Abs(f) > maxMatPow {
+		panic(fmt.Errorf("the matrix power %s is out of range", Float64ToStr(f)))
+	}
+	if f < 0 {
+		m, f = ev.inverse(m), -f
+	}
+	r := identity(rows)
+	for n := int64(f); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			ev.step()
+			r = ev.matMul(r, m)
+		}
+		if n > 1 {
+			ev.step()
+			m = ev.matMul(m, m)
+		}
+	}
+	return r
+}
+
+func identity(n int) List {
+	m := make(List, n)
+	for i := range m {
+		row := make(List, n)
+		for j := range row {
+			row[j] = Integer(0)
+		}
+		row[i] = Integer(1)
+		m[i] = row
+	}
+	return m
+}
+
+// transpose a matrix, a vector becomes a matrix of one row
+func transpose(m List) List {
+	rows, cols, ok := shape(m)
+	if !ok {
+		return List{append(List(nil), m...)}
+	}
+	z := make(List, cols)
+	for j := range z {
+		col := make(List, rows)
+		for i := range col {
+			col[i] = m[i].(List)[j]
+		}
+		z[j] = col
+	}
+	return z
+}
+
+// magnitude is used to choose the pivots of the eliminations, 0 for a zero item
+func magnitude(v Value) float64 {
+	switch v := v.(type) {
+	case Complex:
+		return cmplx.Abs(complex128(v))
+	case Interval:
+		return math.Max(math.Abs(v.Lo), math.Abs(v.Hi))
+	}
+	f, _ := toFloat(v)
+	return math.Abs(f)
+}
+
+// eliminate run a Gauss-Jordan elimination on the rows of m, the columns after the first n are carried along.
+// it returns the reduced rows and the determinant of the n×n part, the rows are nil if it is singular
+func (ev *evaluator) eliminate(m List, n int) (List, Value) {
+	rows := make([]List, len(m))
+	for i, row := range m {
+		rows[i] = append(List(nil), row.(List)...)
+	}
+	var det Value = Integer(1)
+	for c := 0; c < n; c++ {
+		p := c
+		for i := c + 1; i < n; i++ {
+			if magnitude(rows[i][c]) > magnitude(rows[p][c]) {
+				p = i
+			}
+		}
+		if magnitude(rows[p][c]) == 0 {
+			return nil, Integer(0)
+		}
+		if p != c {
+			rows[p], rows[c] = rows[c], rows[p]
+			det = ev.op("-", Integer(0), det)
+		}
+		pivot := rows[c][c]
+		det = ev.op("*", det, pivot)
+		for j := range rows[c] {
+			rows[c][j] = ev.op("/", rows[c][j], pivot)
+		}
+		for i := range rows {
+			if i == c || magnitude(rows[i][c]) == 0 {
+				continue
+			}
+			k := rows[i][c]
+			for j := range rows[i] {
+				rows[i][j] = ev.op("-", rows[i][j], ev.op("*", k, rows[c][j]))
+			}
+		}
+	}
+	z := make(List, len(rows))
+	for i, row := range rows {
+		z[i] = row
+	}
+	return z, det
+}
+
+func (ev *evaluator) determinant(m List) Value {
+	rows, cols, _ := shape(m)
+	if rows != cols {
+		panic(&TypeError{Op: "det", Want: "a square matrix", Got: ListKind})
+	}
+	_, det := ev.eliminate(m, rows)
+	return det
+}
+
+func (ev *evaluator) inverse(m List) List {
+	n, cols, _ := shape(m)
+	if n != cols {
+		panic(&TypeError{Op: "inv", Want: "a square matrix", Got: ListKind})
+	}
+	// [m | I] is reduced to [I | m^-1]
+	aug := make(List, n)
+	for i, row := range identity(n) {
+		aug[i] = append(append(List(nil), m[i].(List)...), row.(List)...)
+	}
+	reduced, _ := ev.eliminate(aug, n)
+	if reduced == nil {
+		panic(errors.New("the matrix is singular"))
+	}
+	z := make(List, n)
+	for i, row := range reduced {
+		z[i] = row.(List)[n:]
+	}
+	return z
+}
+
+// dot([1, 2, 3], [4, 5, 6]) = 32
+
+func defDot(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	a := vectorOf("dot", ev.eval(expr[0], params), -1)
+	b := vectorOf("dot", ev.eval(expr[1], params), len(a))
+	return ev.dot(a, b)
+}
+
+func defDotLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("%s \\cdot %s", e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[1]))
+}
+
+// cross([1, 0, 0], [0, 1, 0]) = [0, 0, 1]
+
+func defCross(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	a := vectorOf("cross", ev.eval(expr[0], params), 3)
+	b := vectorOf("cross", ev.eval(expr[1], params), 3)
+	item := func(i, j int) Value {
+		return ev.op("-", ev.op("*", a[i], b[j]), ev.op("*", a[j], b[i]))
+	}
+	return List{item(1, 2), item(2, 0), item(0, 1)}
+}
+
+func defCrossLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("%s \\times %s", e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[1]))
+}
+
+// norm([3, 4]) = 5
+// norm of a matrix is the Frobenius norm
+
+func defNorm(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	var squares []Value
+	var collect func(v Value)
+	collect = func(v Value) {
+		if l, ok := v.(List); ok {
+			for _, item := range l {
+				collect(item)
+			}
+			return
+		}
+		a := ev.apply("abs", math.Abs, v, expr[0])
+		squares = append(squares, ev.op("*", a, a))
+	}
+	collect(v)
+	return ev.apply("sqrt", math.Sqrt, ev.sumOf(squares...), expr[0])
+}
+
+func defNormLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\left\\| %s \\right\\|", e.ExprASTLaTex(args[0]))
+}
+
+// det([[1, 2], [3, 4]]) = -2
+
+func defDet(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	m, _, _ := matrixOf("det", ev.eval(expr[0], params))
+	return ev.determinant(m)
+}
+
+func defDetLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("\\det\\left(%s\\right)", e.ExprASTLaTex(args[0]))
+}
+
+// inv([[2, 0], [0, 4]]) = [[0.5, 0], [0, 0.25]]
+
+func defInv(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	m, _, _ := matrixOf("inv", ev.eval(expr[0], params))
+	return ev.inverse(m)
+}
+
+func defInvLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("{%s}^{-1}", e.ExprASTLaTex(args[0]))
+}
+
+// transpose([[1, 2], [3, 4]]) = [[1, 3], [2, 4]]
+
+func defTranspose(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	l, ok := v.(List)
+	if !ok {
+		panic(&TypeError{Op: "transpose", Want: "a vector or a matrix", Got: v.Kind()})
+	}
+	return transpose(l)
+}
+
+func defTransposeLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("{%s}^{T}", e.ExprASTLaTex(args[0]))
+}
+
+// listLaTex a matrix literal as rows of a bmatrix, a vector as a column
+func (e *Engine) listLaTex(l ListExprNode) string {
+	rows := make([]string, len(l.Items))
+	for i, item := range l.Items {
+		if row, ok := item.(ListExprNode); ok {
+			cells := make([]string, len(row.Items))
+			for j, cell := range row.Items {
+				cells[j] = e.ExprASTLaTex(cell)
+			}
+			rows[i] = strings.Join(cells, " & ")
+			continue
+		}
+		rows[i] = e.ExprASTLaTex(item)
+	}
+	return "\\begin{bmatrix}" + strings.Join(rows, " \\\\ ") + "\\end{bmatrix}"
+}
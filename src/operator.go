@@ -1,47 +1,152 @@
 package engine
 
 import (
-	"errors"
 	"fmt"
 	"math"
-	"math/big"
 )
 
 const (
 	NonePrecedence = -1
 	NoneResult     = 0.0
+	// PrefixPrecedence is the precedence of the prefix operators - and !,
+	// they bind tighter than * and / but not ^, so -2^2 is -(2^2)
+	PrefixPrecedence = 50
+	// PostfixPrecedence is the precedence of the postfix operators ! and %,
+	// they bind tighter than every other operator, so -3! is -(3!) and 2^3! is 2^(3!)
+	PostfixPrecedence = 70
+)
+
+// Associativity 结合性，决定相同优先级的操作符如何分组
+type Associativity int
+
+const (
+	// LeftAssoc groups a - b - c as (a - b) - c
+	LeftAssoc Associativity = iota
+	// RightAssoc groups a ^ b ^ c as a ^ (b ^ c)
+	RightAssoc
 )
 
 type OperatorUnit interface {
-	Name() byte
+	Name() string
 	Precedence() int
+	Associativity() Associativity
 	Result(a float64, b float64) float64
 	ToLaTex(a string, b string) string
 }
 
-var operators = map[byte]OperatorUnit{
-	'(': &LBrackets{},
-	')': &RBrackets{},
-	'+': &Plus{},
-	'-': &Minus{},
-	'*': &Mul{},
-	'/': &Div{},
-	'^': &Pow{},
-	'%': &Mod{},
+// LazyOperator is implemented by the operators that decide when to evaluate their operands,
+// they receive them unevaluated and the eager Result is not used by the evaluators
+type LazyOperator interface {
+	OperatorUnit
+	// LazyResult calling a or b evaluates the operand
+	LazyResult(a func() float64, b func() float64) float64
+	// LazyResultValue same as LazyResult with typed values
+	LazyResultValue(a func() Value, b func() Value) Value
+}
+
+// ValueOperator is implemented by the operators that handle other values than float64,
+// the other operators convert both operands to numbers and call Result
+type ValueOperator interface {
+	OperatorUnit
+	ResultValue(a Value, b Value) Value
+}
+
+// OperatorKind 操作符相对操作数的位置
+type OperatorKind int
+
+const (
+	// InfixOperator is written between its operands: a op b
+	InfixOperator OperatorKind = iota
+	// PrefixOperator is written before its operand: op a
+	PrefixOperator
+	// PostfixOperator is written after its operand: a op
+	PostfixOperator
+)
+
+// customOperator 通过 RegOperator 注册的操作符，在 float64 上求值
+// a prefix or postfix operator is a binary one whose missing operand is 0, and "" in ToLaTex
+type customOperator struct {
+	name       string
+	kind       OperatorKind
+	precedence int
+	assoc      Associativity
+	eval       func(a, b float64) float64
+	latex      func(a, b string) string
+}
+
+func (c *customOperator) Name() string {
+	return c.name
 }
 
+func (c *customOperator) Precedence() int {
+	return c.precedence
+}
+
+func (c *customOperator) Associativity() Associativity {
+	return c.assoc
+}
+
+func (c *customOperator) Result(a float64, b float64) float64 {
+	return c.eval(a, b)
+}
+
+func (c *customOperator) ToLaTex(a string, b string) string {
+	if c.latex != nil {
+		return c.latex(a, b)
+	}
+	switch c.kind {
+	case PrefixOperator:
+		return c.name + b
+	case PostfixOperator:
+		return a + c.name
+	}
+	return a + " " + c.name + " " + b
+}
+
+var operators = map[string]OperatorUnit{
+	"(": &LBrackets{},
+	")": &RBrackets{},
+	"+": &Plus{},
+	"-": &Minus{},
+	"*": &Mul{},
+	"/": &Div{},
+	"^": &Pow{},
+	"%": &Mod{},
+
+	"<":  &Compare{name: "<", precedence: 15, latex: "<", test: func(c int) bool { return c < 0 }},
+	"<=": &Compare{name: "<=", precedence: 15, latex: "\\leq", test: func(c int) bool { return c <= 0 }},
+	">":  &Compare{name: ">", precedence: 15, latex: ">", test: func(c int) bool { return c > 0 }},
+	">=": &Compare{name: ">=", precedence: 15, latex: "\\geq", test: func(c int) bool { return c >= 0 }},
+	"==": &Compare{name: "==", precedence: 10, latex: "=", test: func(c int) bool { return c == 0 }},
+	"!=": &Compare{name: "!=", precedence: 10, latex: "\\neq", test: func(c int) bool { return c != 0 }},
+
+	"&&":  and,
+	"||":  or,
+	"and": and,
+	"or":  or,
+}
+
+var (
+	and = &Logical{name: "&&", precedence: 6, latex: "\\land", short: false}
+	or  = &Logical{name: "||", precedence: 4, latex: "\\lor", short: true}
+)
+
 // LBrackets 左括号
 type LBrackets struct {
 }
 
-func (L *LBrackets) Name() byte {
-	return '('
+func (L *LBrackets) Name() string {
+	return "("
 }
 
 func (L *LBrackets) Precedence() int {
 	return NonePrecedence
 }
 
+func (L *LBrackets) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (L *LBrackets) Result(a float64, b float64) float64 {
 	return NoneResult
 }
@@ -54,14 +159,18 @@ func (L *LBrackets) ToLaTex(a string, b string) string {
 type RBrackets struct {
 }
 
-func (R *RBrackets) Name() byte {
-	return ')'
+func (R *RBrackets) Name() string {
+	return ")"
 }
 
 func (R *RBrackets) Precedence() int {
 	return NonePrecedence
 }
 
+func (R *RBrackets) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (R *RBrackets) Result(a float64, b float64) float64 {
 	return NoneResult
 }
@@ -74,19 +183,30 @@ func (R *RBrackets) ToLaTex(a string, b string) string {
 type Plus struct {
 }
 
-func (p *Plus) Name() byte {
-	return '+'
+func (p *Plus) Name() string {
+	return "+"
 }
 
 func (p *Plus) Precedence() int {
 	return 20
 }
 
+func (p *Plus) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (p *Plus) Result(a float64, b float64) float64 {
-	lh, _ := new(big.Float).SetString(Float64ToStr(a))
-	rh, _ := new(big.Float).SetString(Float64ToStr(b))
-	f, _ := new(big.Float).Add(lh, rh).Float64()
-	return f
+	return decimalAdd(a, b)
+}
+
+func (p *Plus) ResultValue(a Value, b Value) Value {
+	if x, y, ok := integers(a, b); ok {
+		if r, ok := addInt(x, y); ok {
+			return Integer(r)
+		}
+	}
+	x, y := numbers(p, a, b)
+	return Number(p.Result(x, y))
 }
 
 func (p *Plus) ToLaTex(a string, b string) string {
@@ -97,19 +217,30 @@ func (p *Plus) ToLaTex(a string, b string) string {
 type Minus struct {
 }
 
-func (m *Minus) Name() byte {
-	return '-'
+func (m *Minus) Name() string {
+	return "-"
 }
 
 func (m *Minus) Precedence() int {
 	return 20
 }
 
+func (m *Minus) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (m *Minus) Result(a float64, b float64) float64 {
-	lh, _ := new(big.Float).SetString(Float64ToStr(a))
-	rh, _ := new(big.Float).SetString(Float64ToStr(b))
-	f, _ := new(big.Float).Sub(lh, rh).Float64()
-	return f
+	return decimalAdd(a, -b)
+}
+
+func (m *Minus) ResultValue(a Value, b Value) Value {
+	if x, y, ok := integers(a, b); ok {
+		if r, ok := subInt(x, y); ok {
+			return Integer(r)
+		}
+	}
+	x, y := numbers(m, a, b)
+	return Number(m.Result(x, y))
 }
 
 func (m *Minus) ToLaTex(a string, b string) string {
@@ -120,17 +251,30 @@ func (m *Minus) ToLaTex(a string, b string) string {
 type Mul struct {
 }
 
-func (m *Mul) Name() byte {
-	return '*'
+func (m *Mul) Name() string {
+	return "*"
 }
 
 func (m *Mul) Precedence() int {
 	return 40
 }
 
+func (m *Mul) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (m *Mul) Result(a float64, b float64) float64 {
-	f, _ := new(big.Float).Mul(new(big.Float).SetFloat64(a), new(big.Float).SetFloat64(b)).Float64()
-	return f
+	return a * b
+}
+
+func (m *Mul) ResultValue(a Value, b Value) Value {
+	if x, y, ok := integers(a, b); ok {
+		if r, ok := mulInt(x, y); ok {
+			return Integer(r)
+		}
+	}
+	x, y := numbers(m, a, b)
+	return Number(m.Result(x, y))
 }
 
 func (m *Mul) ToLaTex(a string, b string) string {
@@ -141,23 +285,23 @@ func (m *Mul) ToLaTex(a string, b string) string {
 type Div struct {
 }
 
-func (d *Div) Name() byte {
-	return '/'
+func (d *Div) Name() string {
+	return "/"
 }
 
 func (d *Div) Precedence() int {
 	return 40
 }
 
+func (d *Div) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (d *Div) Result(a float64, b float64) float64 {
 	if b == 0 {
-		panic(errors.New(
-			fmt.Sprintf("violation of arithmetic specification: a division by zero in ExprASTResult: [%g/%g]",
-				a,
-				b)))
+		panic(&DivisionByZeroError{Op: "/", Lhs: a, Rhs: b})
 	}
-	f, _ := new(big.Float).Quo(new(big.Float).SetFloat64(a), new(big.Float).SetFloat64(b)).Float64()
-	return f
+	return a / b
 }
 
 func (d *Div) ToLaTex(a string, b string) string {
@@ -168,24 +312,37 @@ func (d *Div) ToLaTex(a string, b string) string {
 type Mod struct {
 }
 
-func (m *Mod) Name() byte {
-	return '%'
+func (m *Mod) Name() string {
+	return "%"
 }
 
 func (m *Mod) Precedence() int {
 	return 40
 }
 
+func (m *Mod) Associativity() Associativity {
+	return LeftAssoc
+}
+
 func (m *Mod) Result(a float64, b float64) float64 {
-	if b == 0 {
-		panic(errors.New(
-			fmt.Sprintf("violation of arithmetic specification: a division by zero in ExprASTResult: [%g%%%g]",
-				a,
-				b)))
+	// the operands are truncated to integers, a divisor such as 0.5 is zero as well
+	if int(b) == 0 {
+		panic(&DivisionByZeroError{Op: "%", Lhs: a, Rhs: b})
 	}
 	return float64(int(a) % int(b))
 }
 
+func (m *Mod) ResultValue(a Value, b Value) Value {
+	if x, y, ok := integers(a, b); ok {
+		if y == 0 {
+			panic(&DivisionByZeroError{Op: "%", Lhs: float64(x), Rhs: 0})
+		}
+		return Integer(x % y)
+	}
+	x, y := numbers(m, a, b)
+	return Number(m.Result(x, y))
+}
+
 func (m *Mod) ToLaTex(a string, b string) string {
 	return fmt.Sprintf("(%s %% %s)", a, b)
 }
@@ -194,18 +351,179 @@ func (m *Mod) ToLaTex(a string, b string) string {
 type Pow struct {
 }
 
-func (p *Pow) Name() byte {
-	return '^'
+func (p *Pow) Name() string {
+	return "^"
 }
 
 func (p *Pow) Precedence() int {
 	return 60
 }
 
+func (p *Pow) Associativity() Associativity {
+	return RightAssoc
+}
+
 func (p *Pow) Result(a float64, b float64) float64 {
 	return math.Pow(a, b)
 }
 
+func (p *Pow) ResultValue(a Value, b Value) Value {
+	if x, y, ok := integers(a, b); ok && y >= 0 {
+		if r, ok := powInt(x, y); ok {
+			return Integer(r)
+		}
+	}
+	x, y := numbers(p, a, b)
+	return Number(p.Result(x, y))
+}
+
 func (p *Pow) ToLaTex(a string, b string) string {
 	return fmt.Sprintf("%s^{%s}", a, b)
 }
+
+// Compare 比较运算，结果为 Bool，浮点数接口中为 1 或 0
+// <, <=, > and >= bind tighter than == and !=, all of them below + and -
+type Compare struct {
+	name       string
+	precedence int
+	latex      string
+	// test tells whether the operator holds for the result of a three-way comparison
+	test func(c int) bool
+}
+
+func (c *Compare) Name() string {
+	return c.name
+}
+
+func (c *Compare) Precedence() int {
+	return c.precedence
+}
+
+func (c *Compare) Associativity() Associativity {
+	return LeftAssoc
+}
+
+func (c *Compare) Result(a float64, b float64) float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		// NaN is only different from everything
+		return resultFloat(Bool(c.name == "!="))
+	}
+	return resultFloat(Bool(c.test(cmpFloat(a, b))))
+}
+
+func (c *Compare) ToLaTex(a string, b string) string {
+	return fmt.Sprintf("%s %s %s", a, c.latex, b)
+}
+
+// equality reports whether c is == or !=, they also accept the values that are not ordered
+func (c *Compare) equality() bool {
+	return c.name == "==" || c.name == "!="
+}
+
+// Logical 逻辑运算 && 与 ||，关键字 and 与 or 为其别名
+// the right operand is only evaluated when the left one does not decide the result,
+// so that `$d != 0 && $n / $d > 1` never divides by zero
+type Logical struct {
+	name       string
+	precedence int
+	latex      string
+	// short is the value of the left operand deciding the result on its own: false for &&, true for ||
+	short bool
+}
+
+func (l *Logical) Name() string {
+	return l.name
+}
+
+func (l *Logical) Precedence() int {
+	return l.precedence
+}
+
+func (l *Logical) Associativity() Associativity {
+	return LeftAssoc
+}
+
+func (l *Logical) Result(a float64, b float64) float64 {
+	return l.LazyResult(func() float64 { return a }, func() float64 { return b })
+}
+
+func (l *Logical) LazyResult(a func() float64, b func() float64) float64 {
+	if (a() != 0) == l.short {
+		return resultFloat(Bool(l.short))
+	}
+	return resultFloat(Bool(b() != 0))
+}
+
+func (l *Logical) LazyResultValue(a func() Value, b func() Value) Value {
+	if truth(l.name, a()) == l.short {
+		return Bool(l.short)
+	}
+	return Bool(truth(l.name, b()))
+}
+
+func (l *Logical) ToLaTex(a string, b string) string {
+	return fmt.Sprintf("%s %s %s", a, l.latex, b)
+}
+
+// truth returns the boolean value of v for op, the numbers are true when they are not 0
+func truth(op string, v Value) bool {
+	if b, ok := v.(Bool); ok {
+		return bool(b)
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		panic(&TypeError{Op: op, Want: "a boolean", Got: v.Kind()})
+	}
+	return f != 0
+}
+
+// applyOperator evaluate op on values,
+// the numeric kinds fall back to float64 for the operators they do not support
+func (ev *evaluator) applyOperator(op OperatorUnit, a Value, b Value) Value {
+	if c, ok := op.(*Compare); ok {
+		return ev.compare(c, a, b)
+	}
+	if isList(a) || isList(b) {
+		return ev.listOperator(op, a, b)
+	}
+	if isQuantity(a) || isQuantity(b) {
+		return ev.quantityOperator(op, a, b)
+	}
+	if n, ok := dispatch(a, b); ok {
+		if v, ok := n.binary(op.Name(), a, b); ok {
+			return v
+		}
+		ev.inexact(op.Name(), n)
+		x, y := numbers(op, a, b)
+		if _, ok := n.(Interval); ok {
+			r := op.Result(x, y)
+			return widen(r, r)
+		}
+		return Number(op.Result(x, y))
+	}
+	if vo, ok := op.(ValueOperator); ok {
+		return vo.ResultValue(a, b)
+	}
+	x, y := numbers(op, a, b)
+	return Number(op.Result(x, y))
+}
+
+// integers returns the operands if both are integers
+func integers(a Value, b Value) (int64, int64, bool) {
+	x, ok1 := a.(Integer)
+	y, ok2 := b.(Integer)
+	return int64(x), int64(y), ok1 && ok2
+}
+
+// numbers returns the operands as float64, panics with a *TypeError if one is not a number
+func numbers(op OperatorUnit, a Value, b Value) (float64, float64) {
+	x, ok := toFloat(a)
+	if !ok {
+		panic(&TypeError{Op: op.Name(), Want: "number", Got: a.Kind()})
+	}
+	y, ok := toFloat(b)
+	if !ok {
+		panic(&TypeError{Op: op.Name(), Want: "number", Got: b.Kind()})
+	}
+	return x, y
+}
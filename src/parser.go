@@ -21,6 +21,8 @@ type Token struct {
 	Type   int
 	Flag   int
 	Offset int
+	// End is the offset right after the raw characters of the token
+	End int
 }
 
 type Parser struct {
@@ -28,14 +30,40 @@ type Parser struct {
 	ch     byte
 	offset int
 	err    error
+
+	// recovering skips unknown symbols instead of stopping, they are collected in diags
+	recovering bool
+	diags      []Diagnostic
+	limits     Limits
+	// engine provides the operators registered by RegOperator
+	engine *Engine
 }
 
-func Parse(s string) ([]*Token, error) {
+func newParser(e *Engine, s string) *Parser {
 	p := &Parser{
 		Source: s,
 		err:    nil,
-		ch:     s[0],
+		limits: e.Limits,
+		engine: e,
 	}
+	if len(s) > 0 {
+		p.ch = s[0]
+	}
+	return p
+}
+
+// Parse is a Top level function
+// tokenize s with the limits of the default engine
+func Parse(s string) ([]*Token, error) {
+	return std.Parse(s)
+}
+
+// Parse tokenize s, err is a *LimitError if s exceeds Limits.MaxLength or Limits.MaxTokens
+func (e *Engine) Parse(s string) ([]*Token, error) {
+	if len(s) == 0 {
+		return nil, &SyntaxError{code: CodeEmptyExpression, Msg: "empty expression"}
+	}
+	p := newParser(e, s)
 	toks := p.parse()
 	if p.err != nil {
 		return nil, p.err
@@ -44,17 +72,33 @@ func Parse(s string) ([]*Token, error) {
 }
 
 func (p *Parser) parse() []*Token {
+	if max := p.limits.MaxLength; max > 0 && len(p.Source) > max {
+		p.fail(&LimitError{Span: Span{max, len(p.Source)}, Limit: "MaxLength", Max: max})
+		return nil
+	}
 	toks := make([]*Token, 0)
 	for {
 		tok := p.nextTok()
 		if tok == nil {
 			break
 		}
+		if max := p.limits.MaxTokens; max > 0 && len(toks) == max {
+			p.fail(&LimitError{Span: Span{tok.Offset, len(p.Source)}, Limit: "MaxTokens", Max: max})
+			break
+		}
 		toks = append(toks, tok)
 	}
 	return toks
 }
 
+// fail stop tokenizing on err, it is also collected in diags when recovering
+func (p *Parser) fail(err error) {
+	if p.recovering {
+		p.diags = append(p.diags, newDiagnostic(SeverityError, err))
+	}
+	p.err = err
+}
+
 func (p *Parser) nextTok() *Token {
 	if p.offset >= len(p.Source) || p.err != nil {
 		return nil
@@ -66,14 +110,17 @@ func (p *Parser) nextTok() *Token {
 	start := p.offset
 	var tok *Token
 
-	// 判断是否操作符号
-	if operator, ok := operators[p.ch]; ok == true {
+	// 判断是否操作符号或方括号等分隔符，多字符的操作符优先匹配
+	if name := p.operator(); name != "" {
 		tok = &Token{
-			Value: string(operator.Name()),
+			Value: name,
 			Type:  OPERATOR,
 		}
 		tok.Offset = start
-		err = p.nextCh()
+		tok.End = start + len(name)
+		for range name {
+			err = p.nextCh()
+		}
 		return tok
 	}
 
@@ -84,6 +131,7 @@ func (p *Parser) nextTok() *Token {
 			Type:  LITERAL,
 		}
 		tok.Offset = start
+		tok.End = p.offset
 		return tok
 	}
 
@@ -94,6 +142,7 @@ func (p *Parser) nextTok() *Token {
 			Type:  COMMA,
 		}
 		tok.Offset = start
+		tok.End = start + 1
 		err = p.nextCh()
 		return tok
 	}
@@ -105,6 +154,7 @@ func (p *Parser) nextTok() *Token {
 			Type:  VARIABLE,
 		}
 		tok.Offset = start
+		tok.End = p.offset + 1
 		err = p.nextCh()
 		return tok
 	}
@@ -116,18 +166,52 @@ func (p *Parser) nextTok() *Token {
 			Value: p.Source[start:p.offset],
 			Type:  IDENTIFIER,
 		}
+		if p.engine.isSymbol(tok.Value) {
+			tok.Type = OPERATOR
+		}
 		tok.Offset = start
+		tok.End = p.offset
 	} else if p.ch != ' ' {
-		s := fmt.Sprintf("symbol error: unknown '%v', pos [%v:]\n%s",
-			string(p.ch),
-			start,
-			ErrPos(p.Source, start))
-		p.err = errors.New(s)
+		err := &SyntaxError{
+			Span:  Span{start, start + 1},
+			code:  CodeUnknownSymbol,
+			Token: string(p.ch),
+			Msg:   fmt.Sprintf("symbol error: unknown '%v'", string(p.ch)),
+		}
+		if !p.recovering {
+			p.err = err
+			return nil
+		}
+		p.diags = append(p.diags, newDiagnostic(SeverityError, err))
+		if p.nextCh() != nil {
+			return nil
+		}
+		return p.nextTok()
 	}
 
 	return tok
 }
 
+// maxOperatorLen is the length of the longest builtin operator, such as `<=`
+const maxOperatorLen = 2
+
+// operator returns the longest symbol at the current position, empty if there is none.
+// the words such as and are read as identifiers first, so a name starting with or stays a name
+func (p *Parser) operator() string {
+	if p.isChar(p.ch) {
+		return ""
+	}
+	for n := p.engine.operatorLen(); n > 0; n-- {
+		if p.offset+n > len(p.Source) {
+			continue
+		}
+		if p.engine.isSymbol(p.Source[p.offset : p.offset+n]) {
+			return p.Source[p.offset : p.offset+n]
+		}
+	}
+	return ""
+}
+
 func (p *Parser) IsLiteral(v byte) bool {
 	switch v {
 	case
@@ -0,0 +1,345 @@
+package engine
+
+import "strings"
+
+// ConditionalPrecedence is the binding power of `?`, lower than every binary operator
+const ConditionalPrecedence = 2
+
+// prefixRule 前缀规则，操作数的位置以该符号开头时使用
+type prefixRule struct {
+	// power is the binding power of the operand, only the operators binding tighter belong to it.
+	// it is 0 for the brackets, their content is a whole expression
+	power int
+	// parse is called once tok is consumed
+	parse func(a *AST, tok *Token) ExprNode
+}
+
+// infixRule 中缀、后缀与混合规则，跟在左操作数之后
+type infixRule struct {
+	// power is the left binding power, the rule only applies inside an expression whose minimum it reaches
+	power int
+	// parse is called once tok is consumed, lhs is the operand before it
+	parse func(a *AST, lhs ExprNode, tok *Token) ExprNode
+}
+
+var (
+	prefixRules map[string]prefixRule
+	// postfixRules holds the postfix and mixfix rules, the binary operators are the infix rules of operators
+	postfixRules map[string]infixRule
+)
+
+func init() {
+	prefixRules = map[string]prefixRule{
+		"(":   {0, parseGroup},
+		"[":   {0, parseList},
+		"-":   unary(PrefixPrecedence, unaryNode("-")),
+		"+":   unary(PrefixPrecedence, func(span Span, x ExprNode) ExprNode { return withSpan(x, span) }),
+		"!":   unary(PrefixPrecedence, logicalNotCall),
+		"not": unary(PrefixPrecedence, logicalNotCall),
+		// !!x is read as one token, it is still the double negation
+		"!!": unary(PrefixPrecedence, func(span Span, x ExprNode) ExprNode {
+			return logicalNotCall(span, logicalNotCall(span, x))
+		}),
+	}
+	postfixRules = map[string]infixRule{
+		"?":  {ConditionalPrecedence, parseConditional},
+		"!":  postfixCall(PostfixPrecedence, "factorial"),
+		"!!": postfixCall(PostfixPrecedence, "doublefactorial"),
+		"%":  postfixCall(PostfixPrecedence, "percent"),
+	}
+}
+
+// unary returns the rule of a prefix operator, build makes the node from the span of the whole expression and the operand
+func unary(power int, build func(span Span, x ExprNode) ExprNode) prefixRule {
+	return prefixRule{power: power, parse: func(a *AST, tok *Token) ExprNode {
+		x := a.parseExpr(power)
+		if x == nil {
+			return nil
+		}
+		return build(Span{tok.Offset, x.Pos().End}, x)
+	}}
+}
+
+// unaryNode returns the builder of a prefix operator applied as a binary one:
+// -x is 0 - x, the zero is empty at the position of the sign
+func unaryNode(op string) func(span Span, x ExprNode) ExprNode {
+	return func(span Span, x ExprNode) ExprNode {
+		return OperatorExprNode{
+			Span: span,
+			Op:   op,
+			Lhs:  NumberExprNode{Span: Span{span.Start, span.Start}},
+			Rhs:  x,
+		}
+	}
+}
+
+// postfixCall returns the rule of a postfix operator calling the builtin function name, 5! is factorial(5)
+func postfixCall(power int, name string) infixRule {
+	return infixRule{power: power, parse: func(a *AST, lhs ExprNode, tok *Token) ExprNode {
+		return FunCallerExprNode{Span: Span{lhs.Pos().Start, tok.End}, Name: name, Arg: []ExprNode{lhs}}
+	}}
+}
+
+// postfixRule returns the rule of a postfix operator applied as a binary one, x! is x ! 0 with an empty zero after it
+func postfixRule(op OperatorUnit) infixRule {
+	return infixRule{power: op.Precedence(), parse: func(a *AST, lhs ExprNode, tok *Token) ExprNode {
+		return OperatorExprNode{
+			Span: Span{lhs.Pos().Start, tok.End},
+			Op:   op.Name(),
+			Lhs:  lhs,
+			Rhs:  NumberExprNode{Span: Span{tok.End, tok.End}},
+		}
+	}}
+}
+
+func logicalNotCall(span Span, x ExprNode) ExprNode {
+	return FunCallerExprNode{Span: span, Name: "not", Arg: []ExprNode{x}}
+}
+
+// binaryRule returns the infix rule of a binary operator of the operators table
+func binaryRule(op OperatorUnit) infixRule {
+	return infixRule{power: op.Precedence(), parse: func(a *AST, lhs ExprNode, tok *Token) ExprNode {
+		// a right-associative operator takes the next one of the same precedence into its right operand
+		power := op.Precedence() + 1
+		if op.Associativity() == RightAssoc {
+			power--
+		}
+		rhs := a.parseNested(power)
+		if rhs == nil {
+			return nil
+		}
+		// the keywords are aliases, the node holds the symbol of the operator
+		return OperatorExprNode{Span: cover(lhs, rhs), Op: op.Name(), Lhs: lhs, Rhs: rhs}
+	}}
+}
+
+// parseGroup parse the expression in parentheses
+func parseGroup(a *AST, tok *Token) ExprNode {
+	start := tok.Offset
+	e := a.ParseExpression()
+	if e == nil {
+		return nil
+	}
+	if a.eof() {
+		a.report(a.eofError("want ')' but get EOF"))
+		if !a.recovering {
+			return nil
+		}
+		return withSpan(e, Span{start, a.prevEnd})
+	}
+	if a.currTok.Value != ")" {
+		a.report(newSyntaxError(CodeMissingParen, a.currTok, "want ')' but get %s", a.currTok.Value))
+		if !a.recovering {
+			return nil
+		}
+		a.synchronize()
+		if a.eof() || a.currTok.Value != ")" {
+			return withSpan(e, Span{start, a.prevEnd})
+		}
+	}
+	a.getNextToken()
+	// the parentheses belong to the grouped expression
+	return withSpan(e, Span{start, a.prevEnd})
+}
+
+// parseList parse the items of a list literal up to ']'
+func parseList(a *AST, tok *Token) ExprNode {
+	items, complete := a.parseItems("]")
+	if !complete && !a.recovering {
+		return nil
+	}
+	return ListExprNode{Span: Span{tok.Offset, a.prevEnd}, Items: items}
+}
+
+// parseConditional parse `? a : b` after cond into if(cond, a, b),
+// it has the lowest precedence and nests to the right: c1 ? a : c2 ? b : c
+func parseConditional(a *AST, cond ExprNode, tok *Token) ExprNode {
+	// both branches nest, so a chain of conditionals is bounded by Limits.MaxDepth
+	then := a.parseNested(0)
+	if then == nil {
+		return nil
+	}
+	if a.eof() {
+		return a.fail(a.eofError("want ':' but get EOF"))
+	}
+	if a.currTok.Value != ":" {
+		return a.fail(newSyntaxError(CodeUnexpectedToken, a.currTok, "want ':' but get %s", a.currTok.Value))
+	}
+	a.getNextToken()
+	otherwise := a.parseNested(ConditionalPrecedence)
+	if otherwise == nil {
+		return nil
+	}
+	return FunCallerExprNode{
+		Span: cover(cond, otherwise),
+		Name: "if",
+		Arg:  []ExprNode{cond, then, otherwise},
+	}
+}
+
+// prefixRule returns the rule of s at the position of an operand, the builtin rules come first
+func (e *Engine) prefixRule(s string) (prefixRule, bool) {
+	if r, ok := prefixRules[s]; ok {
+		return r, true
+	}
+	if op, ok := e.lookupOperator(s); ok {
+		if c, ok := op.(*customOperator); ok && c.kind == PrefixOperator {
+			return unary(c.precedence, unaryNode(c.name)), true
+		}
+	}
+	return prefixRule{}, false
+}
+
+// infixRule returns the rule of s after an operand, ok is false if s does not continue it.
+// a symbol both postfix and infix such as % is infix only before a token that can only start an operand:
+// 15 % 4 and 15 % (4) but 15% * 2 and 15% + 2
+func (e *Engine) infixRule(s string, operand bool) (infixRule, bool) {
+	if r, ok := postfixRules[s]; ok {
+		if op, infix := e.lookupOperator(s); !infix || op.Precedence() < 0 || !operand {
+			return r, true
+		}
+	}
+	op, ok := e.lookupOperator(s)
+	if !ok || op.Precedence() < 0 {
+		return infixRule{}, false
+	}
+	if c, ok := op.(*customOperator); ok {
+		switch c.kind {
+		case PrefixOperator:
+			return infixRule{}, false
+		case PostfixOperator:
+			return postfixRule(c), true
+		}
+	}
+	return binaryRule(op), true
+}
+
+// isSymbol same as the function isSymbol, with the operators registered in e
+func (e *Engine) isSymbol(s string) bool {
+	if isSymbol(s) {
+		return true
+	}
+	_, ok := e.lookupOperator(s)
+	return ok
+}
+
+// isSymbol reports whether s is a builtin operator or a delimiter of the grammar
+func isSymbol(s string) bool {
+	if _, ok := operators[s]; ok {
+		return true
+	}
+	if _, ok := prefixRules[s]; ok {
+		return true
+	}
+	if _, ok := postfixRules[s]; ok {
+		return true
+	}
+	return s == "]" || s == ":"
+}
+
+// symbolChars are the characters an operator made of punctuation can use,
+// the brackets, ',' and the variable prefixes $ and # are not among them
+const symbolChars = "!%&*+-./:;<=>?@^|~"
+
+// validSymbol reports whether s is a word such as xor or a run of the characters of symbolChars
+func validSymbol(s string) bool {
+	if s == "" {
+		return false
+	}
+	word := 'a' <= s[0] && s[0] <= 'z' || 'A' <= s[0] && s[0] <= 'Z'
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if word && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+		if !word && !strings.ContainsRune(symbolChars, rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// shadows reports whether the symbol s would change the tokens of an input that is valid without it:
+// s made of symbols the grammar accepts in a row such as *- in 2*-3, or ending inside one such as !& in 2!&&1
+func (e *Engine) shadows(s string) bool {
+	if s == "" || !strings.ContainsRune(symbolChars, rune(s[0])) {
+		// a word is read as a whole identifier
+		return false
+	}
+	symbols := e.symbols()
+	return e.run(symbols, s, true, 0) || e.run(symbols, s, false, 0)
+}
+
+// run reports whether s splits into at least two symbols that can follow each other,
+// operand tells whether the first one follows an operand. the last symbol may be cut by the end of s
+func (e *Engine) run(symbols []string, s string, operand bool, pieces int) bool {
+	if s == "" {
+		return pieces >= 2
+	}
+	for n := 1; n <= len(s); n++ {
+		piece, rest := s[:n], s[n:]
+		if e.isSymbol(piece) {
+			for _, next := range e.follow(piece, operand) {
+				if e.run(symbols, rest, next, pieces+1) {
+					return true
+				}
+			}
+		}
+		if rest != "" || pieces == 0 {
+			continue
+		}
+		for _, t := range symbols {
+			if len(t) > len(piece) && strings.HasPrefix(t, piece) && len(e.follow(t, operand)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// follow returns whether an operand is complete after the symbol s, for each way s can be used at that place:
+// after an operand s is postfix or infix, before one it is prefix
+func (e *Engine) follow(s string, operand bool) []bool {
+	var next []bool
+	if !operand {
+		if _, ok := e.prefixRule(s); ok {
+			next = append(next, false)
+		}
+		return next
+	}
+	postfix, infix := false, s == "?" || s == ":"
+	if _, ok := postfixRules[s]; ok && s != "?" {
+		postfix = true
+	}
+	if op, ok := e.lookupOperator(s); ok && op.Precedence() >= 0 {
+		if c, ok := op.(*customOperator); ok && c.kind != InfixOperator {
+			postfix = postfix || c.kind == PostfixOperator
+		} else {
+			infix = true
+		}
+	}
+	if postfix {
+		next = append(next, true)
+	}
+	if infix {
+		next = append(next, false)
+	}
+	return next
+}
+
+// symbols returns every symbol made of punctuation known to e
+func (e *Engine) symbols() []string {
+	symbols := []string{"]", ":"}
+	for s := range prefixRules {
+		symbols = append(symbols, s)
+	}
+	for s := range postfixRules {
+		symbols = append(symbols, s)
+	}
+	e.mu.RLock()
+	for s := range e.ops {
+		symbols = append(symbols, s)
+	}
+	e.mu.RUnlock()
+	return symbols
+}
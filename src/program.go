@@ -0,0 +1,440 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// evalFunc 编译后的求值闭包
+// i is the value of the iteration variable `#i` inside a sum body
+type evalFunc func(params map[string]float64, i float64) float64
+
+type compileFunc func(c *compiler, args []ExprNode) (evalFunc, error)
+
+// Program 编译后的表达式
+// functions, constants and the trigonometric mode are resolved once at compile time,
+// a Program is immutable and can be evaluated from multiple goroutines
+type Program struct {
+	source string
+	eval   evalFunc
+}
+
+// Compile is a Top level function
+// compile s with the default engine
+func Compile(s string) (*Program, error) {
+	return std.Compile(s)
+}
+
+// Compile parse s once and build a reusable Program
+func (e *Engine) Compile(s string) (*Program, error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{
+		engine: e,
+		angle:  e.trigonometricMode() == AngleMode,
+		iters:  1,
+	}
+	f, err := c.compile(ar)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: s, eval: f}, nil
+}
+
+// Eval evaluate the program with params
+// err is not nil if an arithmetic runtime error occurs.
+// a Program does not count steps, Compile rejects the sums that exceed the engine's Limits.MaxIterations
+// Eval allocates nothing unless the expression calls a function registered by RegFunction
+func (p *Program) Eval(params map[string]float64) (r float64, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	return p.eval(params, 0), nil
+}
+
+func (p *Program) String() string {
+	return p.source
+}
+
+type compiler struct {
+	engine *Engine
+	angle  bool
+	// loop is the depth of sum bodies being compiled, `#i` is bound inside them
+	loop int
+	// iters is the number of times the sum body being compiled runs per evaluation,
+	// total counts the iterations of all the sums compiled so far
+	iters float64
+	total float64
+	// call and callName describe the function call being compiled, for error reporting
+	call     Span
+	callName string
+}
+
+func (c *compiler) compile(expr ExprNode) (evalFunc, error) {
+	switch n := expr.(type) {
+	case NumberExprNode:
+		v := n.Val
+		return func(map[string]float64, float64) float64 {
+			return v
+		}, nil
+	case ConstExprNode:
+		v := n.Val
+		return func(map[string]float64, float64) float64 {
+			return v
+		}, nil
+	case VariableExprNode:
+		name := n.Val
+		if name == "#i" && c.loop > 0 {
+			return func(_ map[string]float64, i float64) float64 {
+				return i
+			}, nil
+		}
+		return func(params map[string]float64, _ float64) float64 {
+			return params[name]
+		}, nil
+	case OperatorExprNode:
+		op, ok := c.engine.lookupOperator(n.Op)
+		if !ok {
+			return nil, fmt.Errorf("compile: unknown operator `%s`", n.Op)
+		}
+		l, err := c.compile(n.Lhs)
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.compile(n.Rhs)
+		if err != nil {
+			return nil, err
+		}
+		span := n.Span
+		if lazy, ok := op.(LazyOperator); ok {
+			return func(params map[string]float64, i float64) float64 {
+				defer locate(span)
+				return lazy.LazyResult(
+					func() float64 { return l(params, i) },
+					func() float64 { return r(params, i) },
+				)
+			}, nil
+		}
+		return func(params map[string]float64, i float64) float64 {
+			lv, rv := l(params, i), r(params, i)
+			defer locate(span)
+			return op.Result(lv, rv)
+		}, nil
+	case FunCallerExprNode:
+		def, ok := c.engine.lookupFunc(n.Name)
+		if !ok {
+			return nil, &UndefinedFunctionError{Span: n.Span, Name: n.Name}
+		}
+		if def.compile != nil {
+			c.call, c.callName = n.Span, n.Name
+			f, err := def.compile(c, n.Arg)
+			if err != nil {
+				return nil, err
+			}
+			return locateFunc(f, n.Span), nil
+		}
+		return locateFunc(c.compileCall(def, n.Arg), n.Span), nil
+	case ResultNode:
+		e := c.engine
+		return func(params map[string]float64, _ float64) float64 {
+			return n.Result(e, params)
+		}, nil
+	}
+	return nil, fmt.Errorf("compile: unsupported node %T", expr)
+}
+
+// locateFunc report the panics of f as *EvalError pointing at span
+func locateFunc(f evalFunc, span Span) evalFunc {
+	return func(params map[string]float64, i float64) float64 {
+		defer locate(span)
+		return f(params, i)
+	}
+}
+
+// compileCall call a function registered by RegFunction, its arguments stay as AST nodes
+func (c *compiler) compileCall(def DefineFunc, args []ExprNode) evalFunc {
+	e, fun := c.engine, def.fun
+	if c.loop > 0 {
+		return func(params map[string]float64, i float64) float64 {
+			scope := privateScope(params)
+			scope["#i"] = i
+			return resultFloat(fun(e.newFloatEvaluator(nil), valueParams(scope), args...))
+		}
+	}
+	return func(params map[string]float64, _ float64) float64 {
+		return resultFloat(fun(e.newFloatEvaluator(nil), valueParams(params), args...))
+	}
+}
+
+func compileMath(f func(float64) float64) compileFunc {
+	return func(c *compiler, args []ExprNode) (evalFunc, error) {
+		x, err := c.compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(params map[string]float64, i float64) float64 {
+			return f(x(params, i))
+		}, nil
+	}
+}
+
+// compileTrig same as compileMath, the argument is converted to radian in AngleMode
+func compileTrig(f func(float64) float64) compileFunc {
+	return func(c *compiler, args []ExprNode) (evalFunc, error) {
+		x, err := c.compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if c.angle {
+			return func(params map[string]float64, i float64) float64 {
+				return f(rad(x(params, i)))
+			}, nil
+		}
+		return func(params map[string]float64, i float64) float64 {
+			return f(x(params, i))
+		}, nil
+	}
+}
+
+// compileFold reduce variable-length arguments with f, e.g. max and min
+func compileFold(f func(a, b float64) float64) compileFunc {
+	return func(c *compiler, args []ExprNode) (evalFunc, error) {
+		if len(args) == 0 {
+			return nil, &ArityError{Span: c.call, Name: c.callName, Want: 1, AtLeast: true}
+		}
+		xs := make([]evalFunc, len(args))
+		for k, arg := range args {
+			x, err := c.compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			xs[k] = x
+		}
+		return func(params map[string]float64, i float64) float64 {
+			v := xs[0](params, i)
+			for _, x := range xs[1:] {
+				v = f(v, x(params, i))
+			}
+			return v
+		}, nil
+	}
+}
+
+func compileRound(c *compiler, args []ExprNode) (evalFunc, error) {
+	if len(args) == 0 || len(args) > 2 {
+		err := roundArity(len(args))
+		err.Span = c.call
+		return nil, err
+	}
+	if len(args) == 1 {
+		return compileMath(math.Round)(c, args)
+	}
+	x, err := c.compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.compile(args[1])
+	if err != nil {
+		return nil, err
+	}
+	span := args[1].Pos()
+	return func(params map[string]float64, i float64) float64 {
+		digits := d(params, i)
+		if digits != math.Trunc(digits) {
+			panic(&TypeError{Span: span, Op: "round", Want: "an integer number of digits", Got: NumberKind})
+		}
+		return roundFloat(x(params, i), digits)
+	}, nil
+}
+
+func compileLog(c *compiler, args []ExprNode) (evalFunc, error) {
+	a, err := c.compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.compile(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return func(params map[string]float64, i float64) float64 {
+		return math.Log10(b(params, i)) / math.Log10(a(params, i))
+	}, nil
+}
+
+func compileNoerr(c *compiler, args []ExprNode) (evalFunc, error) {
+	x, err := c.compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return func(params map[string]float64, i float64) (r float64) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if aborted(rec) {
+					panic(rec)
+				}
+				r = 0
+			}
+		}()
+		return x(params, i)
+	}, nil
+}
+
+func compileIf(c *compiler, args []ExprNode) (evalFunc, error) {
+	branches := make([]evalFunc, len(args))
+	for k, arg := range args {
+		f, err := c.compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		branches[k] = f
+	}
+	cond, then, otherwise := branches[0], branches[1], branches[2]
+	return func(params map[string]float64, i float64) float64 {
+		if cond(params, i) != 0 {
+			return then(params, i)
+		}
+		return otherwise(params, i)
+	}, nil
+}
+
+func compileSum(c *compiler, args []ExprNode) (evalFunc, error) {
+	if len(args) < 2 {
+		return nil, &ArityError{Span: c.call, Name: "sum", Want: 2, Got: len(args), AtLeast: true}
+	}
+	start, ok1 := args[0].(NumberExprNode)
+	end, ok2 := args[1].(NumberExprNode)
+	if !ok1 || !ok2 {
+		return nil, errors.New("calling function `sum` cannot be computed efficiently")
+	}
+	// the bounds are literals, so the iteration budget is checked once here instead of at every evaluation
+	n := loopCount(start.Val, end.Val)
+	if len(args) > 2 {
+		n = loopCount(math.Trunc(start.Val), math.Trunc(end.Val))
+	}
+	c.total += c.iters * n
+	if max := c.engine.Limits.MaxIterations; max > 0 && c.total > float64(max) {
+		return nil, &EvalError{Span: c.call, Err: ErrIterationLimit}
+	}
+	if len(args) == 2 {
+		sumV := 0.0
+		for i := start.Val; i <= end.Val; i++ {
+			sumV = sumV + i
+		}
+		return func(map[string]float64, float64) float64 {
+			return sumV
+		}, nil
+	}
+	c.loop++
+	iters := c.iters
+	c.iters *= n
+	body, err := c.compile(args[2])
+	c.iters = iters
+	c.loop--
+	if err != nil {
+		return nil, err
+	}
+	from, to := int(start.Val), int(end.Val)
+	return func(params map[string]float64, _ float64) float64 {
+		// the terms are added like the operator + does, the same way as the evaluator
+		sumV := 0.0
+		for i := from; i <= to; i++ {
+			sumV = decimalAdd(sumV, body(params, float64(i)))
+		}
+		return sumV
+	}, nil
+}
+
+// roundFloat round x to d digits after the decimal point, before it when d is negative
+func roundFloat(x, d float64) float64 {
+	p := math.Pow(10, math.Abs(d))
+	if math.IsInf(p, 0) {
+		// more digits than a float64 holds
+		if d > 0 {
+			return x
+		}
+		return 0
+	}
+	if d < 0 {
+		return math.Round(x/p) * p
+	}
+	return math.Round(x*p) / p
+}
+
+// re, im and arg of a real number
+func re(x float64) float64 {
+	return x
+}
+
+func im(x float64) float64 {
+	return 0
+}
+
+func arg(x float64) float64 {
+	return math.Atan2(0, x)
+}
+
+// rad convert degrees to radians
+func rad(x float64) float64 {
+	return x / 180 * math.Pi
+}
+
+func cot(x float64) float64 {
+	return 1 / math.Tan(x)
+}
+
+func sec(x float64) float64 {
+	return 1 / math.Cos(x)
+}
+
+func csc(x float64) float64 {
+	return 1 / math.Sin(x)
+}
+
+func ln(x float64) float64 {
+	return math.Log10(x) / math.Log10(math.E)
+}
+
+// logicalNot returns 1 for 0 and 0 for the other numbers
+func logicalNot(x float64) float64 {
+	return resultFloat(Bool(x == 0))
+}
+
+// maxIntFactorial is the largest n whose factorial fits in an int64
+const maxIntFactorial = 20
+
+// factorial returns x! as Γ(x+1), NaN for the negative integers where Γ has its poles
+func factorial(x float64) float64 {
+	if x < 0 && x == math.Trunc(x) {
+		return math.NaN()
+	}
+	if x == math.Trunc(x) && x <= maxIntFactorial {
+		r := 1.0
+		for i := 2.0; i <= x; i++ {
+			r *= i
+		}
+		return r
+	}
+	return math.Gamma(x + 1)
+}
+
+// doubleFactorial returns x!! = x (x-2) (x-4) ... down to 1 or 2, defined for the integers from -1, NaN otherwise
+func doubleFactorial(x float64) float64 {
+	if x < -1 || x != math.Trunc(x) {
+		return math.NaN()
+	}
+	r := 1.0
+	for ; x > 1 && !math.IsInf(r, 1); x -= 2 {
+		r *= x
+	}
+	return r
+}
+
+// percent returns x% as a fraction
+func percent(x float64) float64 {
+	return x / 100
+}
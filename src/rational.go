@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// maxRatPow bounds the exponents computed exactly, larger ones fall back to float64
+const maxRatPow = 1 << 16
+
+// maxRatBits bounds the size of the numerator and the denominator of a power, a larger one is ErrRatTooLarge
+const maxRatBits = 1 << 20
+
+// Rational 精确有理数，由 EvalRat 产生
+type Rational struct {
+	*big.Rat
+}
+
+func (x Rational) Kind() Kind {
+	return RatKind
+}
+
+// String returns p/q, or p when the denominator is 1
+func (x Rational) String() string {
+	return x.RatString()
+}
+
+// Node returns x as an expression tree, e.ExprASTLaTex renders it as \frac{p}{q}
+func (x Rational) Node() ExprNode {
+	num := NumberExprNode{Str: x.Num().String()}
+	num.Val, _ = new(big.Float).SetInt(x.Num()).Float64()
+	if x.IsInt() {
+		return num
+	}
+	den := NumberExprNode{Str: x.Denom().String()}
+	den.Val, _ = new(big.Float).SetInt(x.Denom()).Float64()
+	return OperatorExprNode{Op: "/", Lhs: num, Rhs: den}
+}
+
+func (x Rational) rank() int {
+	return rankRat
+}
+
+func (x Rational) float() (float64, bool) {
+	f, _ := x.Float64()
+	return f, true
+}
+
+// toRat convert a number of a lower rank
+func toRat(v Value) *big.Rat {
+	switch v := v.(type) {
+	case Rational:
+		return v.Rat
+	case Integer:
+		return new(big.Rat).SetInt64(int64(v))
+	case Decimal:
+		return v.Rat()
+	}
+	f, _ := toFloat(v)
+	return new(big.Rat).SetFloat64(f)
+}
+
+func (x Rational) binary(op string, a, b Value) (Value, bool) {
+	l, r := toRat(a), toRat(b)
+	z := new(big.Rat)
+	switch op {
+	case "+":
+		z.Add(l, r)
+	case "-":
+		z.Sub(l, r)
+	case "*":
+		z.Mul(l, r)
+	case "/":
+		if r.Sign() == 0 {
+			lf, _ := l.Float64()
+			panic(&DivisionByZeroError{Op: "/", Lhs: lf, Rhs: 0})
+		}
+		z.Quo(l, r)
+	case "%":
+		// the operands are truncated to integers like the float64 version
+		li, ri := ratTrunc(l), ratTrunc(r)
+		if ri.Sign() == 0 {
+			lf, _ := l.Float64()
+			panic(&DivisionByZeroError{Op: "%", Lhs: lf, Rhs: 0})
+		}
+		z.SetInt(li.Rem(li, ri))
+	case "^":
+		if !r.IsInt() || !r.Num().IsInt64() {
+			return nil, false
+		}
+		n := r.Num().Int64()
+		if n > maxRatPow || n < -maxRatPow {
+			return nil, false
+		}
+		if n < 0 {
+			if l.Sign() == 0 {
+				return nil, false
+			}
+			l, n = new(big.Rat).Inv(l), -n
+		}
+		bits := l.Num().BitLen()
+		if d := l.Denom().BitLen(); d > bits {
+			bits = d
+		}
+		if int64(bits-1)*n > maxRatBits {
+			panic(fmt.Errorf("%w: `^` needs about %d bits", ErrRatTooLarge, int64(bits-1)*n))
+		}
+		e := big.NewInt(n)
+		num := new(big.Int).Exp(l.Num(), e, nil)
+		den := new(big.Int).Exp(l.Denom(), e, nil)
+		z.SetFrac(num, den)
+	default:
+		return nil, false
+	}
+	return Rational{z}, true
+}
+
+func (x Rational) cmp(a, b Value) (int, bool) {
+	return toRat(a).Cmp(toRat(b)), true
+}
+
+func (x Rational) call(name string) (Value, bool) {
+	var z *big.Rat
+	switch name {
+	case "abs":
+		z = new(big.Rat).Abs(x.Rat)
+	case "ceil", "floor", "round":
+		z = new(big.Rat).SetInt(ratRound(name, x.Rat))
+	case "sqrt":
+		// only the squares of rationals have an exact root
+		if x.Sign() < 0 {
+			return nil, false
+		}
+		num, den := new(big.Int).Sqrt(x.Num()), new(big.Int).Sqrt(x.Denom())
+		if new(big.Int).Mul(num, num).Cmp(x.Num()) != 0 || new(big.Int).Mul(den, den).Cmp(x.Denom()) != 0 {
+			return nil, false
+		}
+		z = new(big.Rat).SetFrac(num, den)
+	default:
+		return nil, false
+	}
+	return Rational{z}, true
+}
+
+// ratTrunc returns x rounded toward zero
+func ratTrunc(x *big.Rat) *big.Int {
+	return new(big.Int).Quo(x.Num(), x.Denom())
+}
+
+// ratRound ceil, floor and round (half away from zero) of x
+func ratRound(name string, x *big.Rat) *big.Int {
+	switch name {
+	case "ceil":
+		return roundRat(x, 0, RoundCeiling)
+	case "floor":
+		return roundRat(x, 0, RoundFloor)
+	}
+	return roundRat(x, 0, RoundHalfUp)
+}
+
+// ratMode evaluate literals and constants as Rational
+type ratMode struct {
+	strict bool
+}
+
+func (m ratMode) literal(n NumberExprNode) Value {
+	if r, ok := new(big.Rat).SetString(n.Str); ok {
+		return Rational{r}
+	}
+	return Rational{new(big.Rat).SetFloat64(n.Val)}
+}
+
+// constant pi and e are irrational, the other constants are read from their shortest decimal form
+func (m ratMode) constant(n ConstExprNode) Value {
+	if n.Name == "pi" || n.Name == "e" || math.IsInf(n.Val, 0) || math.IsNaN(n.Val) {
+		if m.strict {
+			panic(&EvalError{Span: n.Span, Err: fmt.Errorf("%w: constant `%s`", ErrInexact, n.Name)})
+		}
+		return Number(n.Val)
+	}
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(n.Val, 'g', -1, 64))
+	return Rational{r}
+}
+
+// EvalRat parse s and evaluate it exactly with big.Rat: literals, + - * /, % and integer powers.
+// the irrational functions such as sqrt or sin, and the constants pi and e, fall back to float64 and
+// the result is then a Number, with e.StrictRat they fail with ErrInexact instead.
+// the result is a Rational otherwise
+func (e *Engine) EvalRat(s string, params map[string]*big.Rat) (v Value, err error) {
+	ar, err := e.parseExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = rec.(error)
+		}
+	}()
+	values := make(map[string]Value, len(params))
+	for k, v := range params {
+		values[k] = Rational{v}
+	}
+	ev := e.newEvaluator(nil, Rational{new(big.Rat)})
+	ev.mode = ratMode{e.StrictRat}
+	ev.strict = e.StrictRat
+	switch v := ev.eval(ar, values).(type) {
+	case Integer:
+		return Rational{new(big.Rat).SetInt64(int64(v))}, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,385 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// dimension exponents of the SI base units m, kg, s, A, K, mol and cd
+type dimension [7]int8
+
+// unitDef 命名单位，scale 为换算到 SI 基本单位的倍数
+type unitDef struct {
+	scale *big.Rat
+	dim   dimension
+}
+
+func newUnitDef(scale string, dim dimension) unitDef {
+	r, _ := new(big.Rat).SetString(scale)
+	return unitDef{scale: r, dim: dim}
+}
+
+var (
+	dimLength  = dimension{1}
+	dimMass    = dimension{0, 1}
+	dimTime    = dimension{0, 0, 1}
+	dimCurrent = dimension{0, 0, 0, 1}
+	dimVolume  = dimension{3}
+	dimForce   = dimension{1, 1, -2}
+	dimEnergy  = dimension{2, 1, -2}
+	dimPower   = dimension{2, 1, -3}
+)
+
+// defUnit the builtin units, the names are matched after a number or where a constant is expected
+var defUnit = map[string]unitDef{
+	"m":  newUnitDef("1", dimLength),
+	"km": newUnitDef("1000", dimLength),
+	"cm": newUnitDef("1/100", dimLength),
+	"mm": newUnitDef("1/1000", dimLength),
+	"um": newUnitDef("1/1000000", dimLength),
+	"nm": newUnitDef("1/1000000000", dimLength),
+	"in": newUnitDef("0.0254", dimLength),
+	"ft": newUnitDef("0.3048", dimLength),
+	"yd": newUnitDef("0.9144", dimLength),
+	"mi": newUnitDef("1609.344", dimLength),
+
+	"kg": newUnitDef("1", dimMass),
+	"g":  newUnitDef("1/1000", dimMass),
+	"mg": newUnitDef("1/1000000", dimMass),
+	"t":  newUnitDef("1000", dimMass),
+	"lb": newUnitDef("0.45359237", dimMass),
+
+	"s":   newUnitDef("1", dimTime),
+	"ms":  newUnitDef("1/1000", dimTime),
+	"min": newUnitDef("60", dimTime),
+	"h":   newUnitDef("3600", dimTime),
+	"day": newUnitDef("86400", dimTime),
+
+	"A":   newUnitDef("1", dimCurrent),
+	"mA":  newUnitDef("1/1000", dimCurrent),
+	"K":   newUnitDef("1", dimension{0, 0, 0, 0, 1}),
+	"mol": newUnitDef("1", dimension{0, 0, 0, 0, 0, 1}),
+	"cd":  newUnitDef("1", dimension{0, 0, 0, 0, 0, 0, 1}),
+
+	"L":   newUnitDef("1/1000", dimVolume),
+	"mL":  newUnitDef("1/1000000", dimVolume),
+	"Hz":  newUnitDef("1", dimension{0, 0, -1}),
+	"N":   newUnitDef("1", dimForce),
+	"kN":  newUnitDef("1000", dimForce),
+	"Pa":  newUnitDef("1", dimension{-1, 1, -2}),
+	"J":   newUnitDef("1", dimEnergy),
+	"kJ":  newUnitDef("1000", dimEnergy),
+	"kWh": newUnitDef("3600000", dimEnergy),
+	"W":   newUnitDef("1", dimPower),
+	"kW":  newUnitDef("1000", dimPower),
+	"C":   newUnitDef("1", dimension{0, 0, 1, 1}),
+	"V":   newUnitDef("1", dimension{2, 1, -3, -1}),
+}
+
+func isUnitName(name string) bool {
+	_, ok := defUnit[name]
+	return ok
+}
+
+// unitFactor a named unit to an integer power
+type unitFactor struct {
+	name  string
+	power int
+}
+
+// Unit 单位，命名单位的幂的乘积，例如 km/h 或 kg*m/s^2
+// the zero Unit is dimensionless
+type Unit struct {
+	factors []unitFactor
+}
+
+// ParseUnit read a unit written like in the expressions, e.g. "km/h" or "kg*m/s^2"
+func ParseUnit(s string) (Unit, error) {
+	node, err := std.parseExpr(s)
+	if err != nil {
+		return Unit{}, err
+	}
+	q, ok := node.(QuantityExprNode)
+	if !ok || q.Val != nil {
+		return Unit{}, fmt.Errorf("ParseUnit: invalid unit %q", s)
+	}
+	return q.Unit, nil
+}
+
+// IsZero reports whether u is dimensionless without any named unit
+func (u Unit) IsZero() bool {
+	return len(u.factors) == 0
+}
+
+// String returns u as it is written in the expressions, e.g. kg*m/s^2
+func (u Unit) String() string {
+	return u.format("*", func(name string, p int) string {
+		if p == 1 {
+			return name
+		}
+		return fmt.Sprintf("%s^%d", name, p)
+	})
+}
+
+// LaTex returns u for a LaTeX formula, e.g. \mathrm{kg \cdot m/s^{2}}
+func (u Unit) LaTex() string {
+	return "\\mathrm{" + u.format(" \\cdot ", func(name string, p int) string {
+		if p == 1 {
+			return name
+		}
+		return fmt.Sprintf("%s^{%d}", name, p)
+	}) + "}"
+}
+
+// format write the positive powers joined by mul, then every negative one after a '/'
+func (u Unit) format(mul string, factor func(name string, p int) string) string {
+	var num []string
+	var den string
+	for _, f := range u.factors {
+		if f.power > 0 {
+			num = append(num, factor(f.name, f.power))
+		} else {
+			den += "/" + factor(f.name, -f.power)
+		}
+	}
+	if len(num) == 0 {
+		return "1" + den
+	}
+	return strings.Join(num, mul) + den
+}
+
+func (u Unit) dim() dimension {
+	var d dimension
+	for _, f := range u.factors {
+		def := defUnit[f.name]
+		for i := range d {
+			d[i] += def.dim[i] * int8(f.power)
+		}
+	}
+	return d
+}
+
+// scale returns the factor converting u to the SI base units
+func (u Unit) scale() *big.Rat {
+	r := big.NewRat(1, 1)
+	for _, f := range u.factors {
+		r.Mul(r, ratPow(defUnit[f.name].scale, f.power))
+	}
+	return r
+}
+
+func ratPow(x *big.Rat, n int) *big.Rat {
+	r := big.NewRat(1, 1)
+	if n < 0 {
+		x, n = new(big.Rat).Inv(x), -n
+	}
+	for ; n > 0; n-- {
+		r.Mul(r, x)
+	}
+	return r
+}
+
+// with returns u·name^power, the powers of the same name are added and the zero powers dropped
+func (u Unit) with(name string, power int) Unit {
+	z := Unit{factors: make([]unitFactor, 0, len(u.factors)+1)}
+	found := false
+	for _, f := range u.factors {
+		if f.name == name {
+			f.power += power
+			found = true
+		}
+		if f.power != 0 {
+			z.factors = append(z.factors, f)
+		}
+	}
+	if !found && power != 0 {
+		z.factors = append(z.factors, unitFactor{name, power})
+	}
+	return z
+}
+
+// mul returns u·v^sign and the factor of the magnitude,
+// a unit of v with the same dimension as a unit of u is converted into it, so that km/h * s is km
+func (u Unit) mul(v Unit, sign int) (Unit, *big.Rat) {
+	z, r := u, big.NewRat(1, 1)
+	for _, f := range v.factors {
+		name, p := f.name, f.power*sign
+		for _, g := range z.factors {
+			if g.name != name && defUnit[g.name].dim == defUnit[name].dim {
+				r.Mul(r, ratPow(new(big.Rat).Quo(defUnit[name].scale, defUnit[g.name].scale), p))
+				name = g.name
+				break
+			}
+		}
+		z = z.with(name, p)
+	}
+	return z, r
+}
+
+// pow returns u^p, ok is false if a power is not an integer
+func (u Unit) pow(p float64) (Unit, bool) {
+	var z Unit
+	for _, f := range u.factors {
+		q := float64(f.power) * p
+		if q != math.Trunc(q) || math.Abs(q) > math.MaxInt16 {
+			return Unit{}, false
+		}
+		z = z.with(f.name, int(q))
+	}
+	return z, true
+}
+
+// Quantity 带单位的物理量，例如 3 m 或 5 km/h
+type Quantity struct {
+	// Val is the magnitude in Unit, it may be of any numeric kind
+	Val  Value
+	Unit Unit
+}
+
+func (q Quantity) Kind() Kind {
+	return QuantityKind
+}
+
+func (q Quantity) String() string {
+	return q.Val.String() + " " + q.Unit.String()
+}
+
+func isQuantity(v Value) bool {
+	_, ok := v.(Quantity)
+	return ok
+}
+
+// quantity returns v in u, a plain number if u has no named unit
+func quantity(v Value, u Unit) Value {
+	if u.IsZero() {
+		return v
+	}
+	return Quantity{Val: v, Unit: u}
+}
+
+// quantityOf returns v as a quantity, plain numbers are dimensionless
+func quantityOf(v Value) Quantity {
+	if q, ok := v.(Quantity); ok {
+		return q
+	}
+	return Quantity{Val: v}
+}
+
+// isZero reports whether v is the plain number 0, it is compatible with every unit
+func isZero(v Value) bool {
+	if isQuantity(v) {
+		return false
+	}
+	f, ok := toFloat(v)
+	return ok && f == 0
+}
+
+// rescale multiply v by r, as an integer product and quotient so that the exact kinds stay exact
+func (ev *evaluator) rescale(v Value, r *big.Rat) Value {
+	if num := r.Num(); !num.IsInt64() || num.Int64() != 1 {
+		v = ev.op("*", v, bigIntValue(num))
+	}
+	if den := r.Denom(); !den.IsInt64() || den.Int64() != 1 {
+		v = ev.op("/", v, bigIntValue(den))
+	}
+	return v
+}
+
+func bigIntValue(n *big.Int) Value {
+	if n.IsInt64() {
+		return Integer(n.Int64())
+	}
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return Number(f)
+}
+
+// convert returns the magnitude of q in u, panics with a *UnitError for op if the dimensions differ
+func (ev *evaluator) convert(op string, q Quantity, u Unit) Value {
+	if q.Unit.dim() != u.dim() {
+		panic(&UnitError{Op: op, Want: "a unit compatible with " + u.String(), Got: q.Unit})
+	}
+	return ev.rescale(q.Val, new(big.Rat).Quo(q.Unit.scale(), u.scale()))
+}
+
+// quantityOperator `+`, `-` and `%` convert the right operand to the unit of the left one,
+// `*` and `/` combine the units and `^` multiplies their powers
+func (ev *evaluator) quantityOperator(op OperatorUnit, a, b Value) Value {
+	x, y := quantityOf(a), quantityOf(b)
+	switch name := op.Name(); name {
+	case "*", "/":
+		sign := 1
+		if name == "/" {
+			sign = -1
+		}
+		u, r := x.Unit.mul(y.Unit, sign)
+		return quantity(ev.rescale(ev.applyOperator(op, x.Val, y.Val), r), u)
+	case "^":
+		e := ev.convert("^", y, Unit{})
+		if !isQuantity(a) {
+			return ev.applyOperator(op, a, e)
+		}
+		p, ok := toFloat(e)
+		u, ok2 := x.Unit.pow(p)
+		if !ok || !ok2 {
+			panic(&UnitError{Op: "^", Want: "an exponent giving integer powers", Got: x.Unit})
+		}
+		return quantity(ev.applyOperator(op, x.Val, e), u)
+	default:
+		l, r, u := ev.sameUnit(name, a, b)
+		return quantity(ev.applyOperator(op, l, r), u)
+	}
+}
+
+// sameUnit returns the magnitudes of a and b in the unit of a, for op which wants compatible units.
+// the plain number 0 takes the unit of the other operand
+func (ev *evaluator) sameUnit(op string, a, b Value) (Value, Value, Unit) {
+	x, y := quantityOf(a), quantityOf(b)
+	switch {
+	case isZero(a):
+		x.Unit = y.Unit
+	case isZero(b):
+		y.Unit = x.Unit
+	}
+	return x.Val, ev.convert(op, y, x.Unit), x.Unit
+}
+
+// quantityCall the rounding functions keep the unit, sqrt and cbrt take the root of the powers
+// and the other functions want a dimensionless argument
+func (ev *evaluator) quantityCall(name string, f func(float64) float64, q Quantity, expr ExprNode) Value {
+	switch name {
+	case "abs", "ceil", "floor", "round", "re", "im", "conj":
+		return quantity(ev.apply(name, f, q.Val, expr), q.Unit)
+	case "sqrt", "cbrt":
+		n := 2.0
+		if name == "cbrt" {
+			n = 3
+		}
+		u, ok := q.Unit.pow(1 / n)
+		if !ok {
+			panic(&UnitError{Span: expr.Pos(), Op: name, Want: "a unit with powers divisible by " + Float64ToStr(n), Got: q.Unit})
+		}
+		return quantity(ev.apply(name, f, q.Val, expr), u)
+	}
+	if q.Unit.dim() != (dimension{}) {
+		panic(&UnitError{Span: expr.Pos(), Op: name, Want: "a dimensionless quantity", Got: q.Unit})
+	}
+	return ev.apply(name, f, ev.convert(name, q, Unit{}), expr)
+}
+
+// to(5 km/h, m/s) = 1.3888888888888888 m/s
+
+func defTo(ev *evaluator, params map[string]Value, expr ...ExprNode) Value {
+	v := ev.eval(expr[0], params)
+	target := ev.eval(expr[1], params)
+	u, ok := target.(Quantity)
+	if !ok {
+		panic(&TypeError{Span: expr[1].Pos(), Op: "to", Want: "a unit", Got: target.Kind()})
+	}
+	return Quantity{Val: ev.convert("to", quantityOf(v), u.Unit), Unit: u.Unit}
+}
+
+func defToLaTex(e *Engine, args ...ExprNode) string {
+	return fmt.Sprintf("%s \\to %s", e.ExprASTLaTex(args[0]), e.ExprASTLaTex(args[1]))
+}
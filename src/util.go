@@ -1,8 +1,9 @@
 package engine
 
 import (
-	"errors"
+	"context"
 	"math"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -11,24 +12,49 @@ import (
 // Analytical expression and execution
 // err is not nil if an error occurs (including arithmetic runtime errors)
 func ParseAndExec(s string, params map[string]float64) (r float64, err error) {
-	toks, err := Parse(s)
-	if err != nil {
-		return 0, err
-	}
-	ast := NewAST(toks, s)
-	if ast.Err != nil {
-		return 0, ast.Err
-	}
-	ar := ast.ParseExpression()
-	if ast.Err != nil {
-		return 0, ast.Err
-	}
-	defer func() {
-		if e := recover(); e != nil {
-			err = e.(error)
-		}
-	}()
-	return ExprASTResult(ar, params), err
+	return std.ParseAndExec(s, params)
+}
+
+// EvalValue Top level function
+// parse s and evaluate it with typed values using the default engine
+func EvalValue(s string, params map[string]Value) (Value, error) {
+	return std.EvalValue(s, params)
+}
+
+// EvalContext Top level function
+// same as ParseAndExec, the evaluation stops as soon as ctx is done or the default engine's Limits are exceeded
+func EvalContext(ctx context.Context, s string, params map[string]float64) (r float64, err error) {
+	return std.EvalContext(ctx, s, params)
+}
+
+// EvalBig Top level function
+// parse s and evaluate it with big.Float using the default engine, see Engine.EvalBig
+func EvalBig(s string, params map[string]*big.Float) (*big.Float, error) {
+	return std.EvalBig(s, params)
+}
+
+// EvalRat Top level function
+// parse s and evaluate it exactly with big.Rat using the default engine, see Engine.EvalRat
+func EvalRat(s string, params map[string]*big.Rat) (Value, error) {
+	return std.EvalRat(s, params)
+}
+
+// EvalDecimal Top level function
+// parse s and evaluate it with decimal fixed-point arithmetic using the default engine, see Engine.EvalDecimal
+func EvalDecimal(s string, params map[string]Decimal) (Decimal, error) {
+	return std.EvalDecimal(s, params)
+}
+
+// EvalComplex Top level function
+// parse s and evaluate it with complex numbers using the default engine, see Engine.EvalComplex
+func EvalComplex(s string, params map[string]complex128) (complex128, error) {
+	return std.EvalComplex(s, params)
+}
+
+// EvalInterval Top level function
+// parse s and evaluate it with interval arithmetic using the default engine, see Engine.EvalInterval
+func EvalInterval(s string, params map[string]Interval) (Interval, error) {
+	return std.EvalInterval(s, params)
 }
 
 func ErrPos(s string, pos int) string {
@@ -41,14 +67,6 @@ func ErrPos(s string, pos int) string {
 	return r + s + r
 }
 
-func expr2Radian(expr ExprNode, params map[string]float64) float64 {
-	r := ExprASTResult(expr, params)
-	if TrigonometricMode == AngleMode {
-		r = r / 180 * math.Pi
-	}
-	return r
-}
-
 // Float64ToStr float64 -> string
 func Float64ToStr(f float64) string {
 	return strconv.FormatFloat(f, 'f', -1, 64)
@@ -63,95 +81,114 @@ func Float64ToStr(f float64) string {
 //
 // fun:  function handler
 func RegFunction(name string, argc int, fun func(map[string]float64, ...ExprNode) float64, funLaTex func(...ExprNode) string) error {
-	if len(name) == 0 {
-		return errors.New("RegFunction name is not empty")
-	}
-	if argc < -1 {
-		return errors.New("RegFunction argc should be -1, 0, or a positive integer")
-	}
-	if _, ok := defFunc[name]; ok {
-		return errors.New("RegFunction name is already exist")
-	}
-	if funLaTex == nil {
-		defFunc[name] = DefineFunc{argc, fun, defaultLaTexFunc}
-	} else {
-		defFunc[name] = DefineFunc{argc, fun, funLaTex}
-	}
-	return nil
+	return std.RegFunction(name, argc, fun, funLaTex)
+}
+
+// RegValueFunction is Top level function
+// register a function working on typed values, see Engine.RegValueFunction
+func RegValueFunction(name string, argc int, fun func(...Value) (Value, error), funLaTex func(...ExprNode) string) error {
+	return std.RegValueFunction(name, argc, fun, funLaTex)
+}
+
+// RegOperator is Top level function
+// register an operator to use in expressions, see Engine.RegOperator
+func RegOperator(symbol string, kind OperatorKind, precedence int, assoc Associativity, eval func(a, b float64) float64, latex func(a, b string) string) error {
+	return std.RegOperator(symbol, kind, precedence, assoc, eval, latex)
 }
 
 func RegConst(name string, value float64) error {
-	if len(name) == 0 {
-		return errors.New("RegConst name is not empty")
-	}
-	if _, ok := defConst[name]; ok {
-		return errors.New("RegConst name is already exist")
-	}
-	defConst[name] = value
-	return nil
+	return std.RegConst(name, value)
 }
 
 func RegConstLaTex(name string, value string) error {
-	if len(name) == 0 {
-		return errors.New("RegConstLaTex name is not empty")
-	}
-	if _, ok := defConstLaTex[name]; ok {
-		return errors.New("RegConstLaTex name is already exist")
-	}
-	defConstLaTex[name] = value
-	return nil
+	return std.RegConstLaTex(name, value)
 }
 
 // ExprASTResult is a Top level function
 // AST traversal
 // if an arithmetic runtime error occurs, a panic exception is thrown
 func ExprASTResult(expr ExprNode, params map[string]float64) float64 {
-	var l, r float64
-	switch expr.(type) {
-	case OperatorExprNode:
-		ast := expr.(OperatorExprNode)
-		l = ExprASTResult(ast.Lhs, params)
-		r = ExprASTResult(ast.Rhs, params)
-		return operators[ast.Op[0]].Result(l, r)
-	case NumberExprNode:
-		return expr.(NumberExprNode).Val
-	case ConstExprNode:
-		return expr.(ConstExprNode).Val
-	case VariableExprNode:
-		val := expr.(VariableExprNode).Val
-		return params[val]
-	case FunCallerExprNode:
-		f := expr.(FunCallerExprNode)
-		def := defFunc[f.Name]
-		return def.fun(params, f.Arg...)
-	}
+	return std.ExprASTResult(expr, params)
+}
 
-	return 0.0
+// ExprASTValue is a Top level function
+// AST traversal with typed values
+func ExprASTValue(expr ExprNode, params map[string]Value) Value {
+	return std.ExprASTValue(expr, params)
 }
 
 func ExprASTLaTex(expr ExprNode) string {
-	var l, r string
-	switch expr.(type) {
-	case OperatorExprNode:
-		ast := expr.(OperatorExprNode)
-		l = ExprASTLaTex(ast.Lhs)
-		r = ExprASTLaTex(ast.Rhs)
-		return operators[ast.Op[0]].ToLaTex(l, r)
-	case NumberExprNode:
-		return expr.(NumberExprNode).Str
-	case ConstExprNode:
-		node := expr.(ConstExprNode)
-		if defConstLaTex[node.Name] != "" {
-			return defConstLaTex[node.Name]
+	return std.ExprASTLaTex(expr)
+}
+
+var pow10Int = [...]int64{
+	1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9,
+	1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18,
+}
+
+// decimalAdd a + b computed on the shortest decimal representations of a and b,
+// so 0.1 + 0.2 = 0.3 just like the literals suggest.
+// the common cases are handled on the stack, the rest falls back to big.Float
+func decimalAdd(a, b float64) float64 {
+	if a == 0 || b == 0 || isSafeInt(a) && isSafeInt(b) ||
+		math.IsInf(a, 0) || math.IsInf(b, 0) || math.IsNaN(a) || math.IsNaN(b) {
+		return a + b
+	}
+	var bufA, bufB, bufR [32]byte
+	ma, ea := decimalParts(strconv.AppendFloat(bufA[:0], a, 'e', -1, 64))
+	mb, eb := decimalParts(strconv.AppendFloat(bufB[:0], b, 'e', -1, 64))
+	if ea < eb {
+		ma, ea, mb, eb = mb, eb, ma, ea
+	}
+	// align ma to the smaller exponent, both mantissas stay below MaxInt64/2 so the sum cannot overflow
+	if k := ea - eb; k < len(pow10Int) && abs64(ma) <= math.MaxInt64/2/pow10Int[k] {
+		m := ma*pow10Int[k] + mb
+		r := strconv.AppendInt(bufR[:0], m, 10)
+		r = append(r, 'e')
+		r = strconv.AppendInt(r, int64(eb), 10)
+		f, _ := strconv.ParseFloat(string(r), 64)
+		return f
+	}
+	lh, _ := new(big.Float).SetString(Float64ToStr(a))
+	rh, _ := new(big.Float).SetString(Float64ToStr(b))
+	f, _ := new(big.Float).Add(lh, rh).Float64()
+	return f
+}
+
+// decimalParts split the 'e' formatted float s into m * 10^exp
+func decimalParts(s []byte) (m int64, exp int) {
+	neg := false
+	frac := 0
+	dot := false
+	i := 0
+	if s[0] == '-' {
+		neg = true
+		i++
+	}
+	for ; i < len(s) && s[i] != 'e'; i++ {
+		if s[i] == '.' {
+			dot = true
+			continue
 		}
-		return expr.(ConstExprNode).Name
-	case VariableExprNode:
-		return expr.(VariableExprNode).Val[1:]
-	case FunCallerExprNode:
-		f := expr.(FunCallerExprNode)
-		def := defFunc[f.Name]
-		return def.funLaTex(f.Arg...)
+		m = m*10 + int64(s[i]-'0')
+		if dot {
+			frac++
+		}
+	}
+	e, _ := strconv.Atoi(string(s[i+1:]))
+	if neg {
+		m = -m
 	}
+	return m, e - frac
+}
 
-	return ""
+func isSafeInt(f float64) bool {
+	return f == math.Trunc(f) && math.Abs(f) <= 1<<53
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
 }
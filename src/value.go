@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Kind 值的类型
+type Kind int
+
+const (
+	NullKind Kind = iota
+	NumberKind
+	IntegerKind
+	BoolKind
+	StringKind
+	ListKind
+	BigKind
+	RatKind
+	DecimalKind
+	ComplexKind
+	IntervalKind
+	QuantityKind
+)
+
+var kindNames = [...]string{
+	NullKind:     "null",
+	NumberKind:   "number",
+	IntegerKind:  "integer",
+	BoolKind:     "boolean",
+	StringKind:   "string",
+	ListKind:     "list",
+	BigKind:      "bigfloat",
+	RatKind:      "rational",
+	DecimalKind:  "decimal",
+	ComplexKind:  "complex",
+	IntervalKind: "interval",
+	QuantityKind: "quantity",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+// Value 表达式求值的结果
+// the builtin kinds are Number, Integer, Bool, String, List, Null, BigFloat, Rational, Decimal, Complex, Interval and Quantity
+type Value interface {
+	Kind() Kind
+	String() string
+}
+
+// Number 浮点数
+type Number float64
+
+func (n Number) Kind() Kind {
+	return NumberKind
+}
+
+func (n Number) String() string {
+	return Float64ToStr(float64(n))
+}
+
+// Integer 整数，运算溢出时退化为 Number
+type Integer int64
+
+func (n Integer) Kind() Kind {
+	return IntegerKind
+}
+
+func (n Integer) String() string {
+	return strconv.FormatInt(int64(n), 10)
+}
+
+// Bool 布尔值
+type Bool bool
+
+func (b Bool) Kind() Kind {
+	return BoolKind
+}
+
+func (b Bool) String() string {
+	return strconv.FormatBool(bool(b))
+}
+
+// String 字符串，String() returns it quoted
+type String string
+
+func (s String) Kind() Kind {
+	return StringKind
+}
+
+func (s String) String() string {
+	return strconv.Quote(string(s))
+}
+
+// List 值的列表
+type List []Value
+
+func (l List) Kind() Kind {
+	return ListKind
+}
+
+func (l List) String() string {
+	items := make([]string, len(l))
+	for i, v := range l {
+		items[i] = v.String()
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+// Null 空值，未赋值的变量求值为 Null
+type Null struct{}
+
+func (Null) Kind() Kind {
+	return NullKind
+}
+
+func (Null) String() string {
+	return "null"
+}
+
+// ranks of the numeric tower, an operation on two numbers is done by the kind of the higher rank
+const (
+	rankInteger = iota * 10
+	rankDecimal
+	rankRat
+	rankNumber
+	rankBig
+	rankComplex
+	rankInterval
+)
+
+// numeric is implemented by the number kinds other than Number and Integer,
+// each one converts the lower ranked numbers it meets
+type numeric interface {
+	Value
+	rank() int
+	// binary evaluate a op b, one operand has the kind of the receiver and the other a lower rank,
+	// ok is false if the operator is not supported
+	binary(op string, a, b Value) (v Value, ok bool)
+	// cmp compare a and b like binary, ok is false if the kind is not ordered
+	cmp(a, b Value) (c int, ok bool)
+	// call evaluate the builtin function name on the receiver, ok is false if it is not supported
+	call(name string) (v Value, ok bool)
+	// float returns the nearest float64, ok is false if there is none
+	float() (f float64, ok bool)
+}
+
+func rankOf(v Value) int {
+	switch v := v.(type) {
+	case Integer:
+		return rankInteger
+	case Number:
+		return rankNumber
+	case numeric:
+		return v.rank()
+	}
+	return -1
+}
+
+// dispatch returns the numeric handling an operation on a and b,
+// ok is false if none of them is a numeric or one of them is not a number at all
+func dispatch(a, b Value) (numeric, bool) {
+	ra, rb := rankOf(a), rankOf(b)
+	if ra < 0 || rb < 0 {
+		return nil, false
+	}
+	if n, ok := a.(numeric); ok && ra >= rb {
+		return n, true
+	}
+	n, ok := b.(numeric)
+	return n, ok
+}
+
+// ValueOf convert a Go value into a Value,
+// supports the numeric types, bool, string, nil, slices of those and Value itself
+func ValueOf(x interface{}) (Value, error) {
+	switch x := x.(type) {
+	case Value:
+		return x, nil
+	case nil:
+		return Null{}, nil
+	case float64:
+		return Number(x), nil
+	case float32:
+		return Number(x), nil
+	case int:
+		return Integer(x), nil
+	case int32:
+		return Integer(x), nil
+	case int64:
+		return Integer(x), nil
+	case uint32:
+		return Integer(x), nil
+	case *big.Float:
+		return BigFloat{x}, nil
+	case *big.Rat:
+		return Rational{x}, nil
+	case complex128:
+		return Complex(x), nil
+	case bool:
+		return Bool(x), nil
+	case string:
+		return String(x), nil
+	case []Value:
+		return List(x), nil
+	case []float64:
+		l := make(List, len(x))
+		for i, v := range x {
+			l[i] = Number(v)
+		}
+		return l, nil
+	case []interface{}:
+		l := make(List, len(x))
+		for i, v := range x {
+			item, err := ValueOf(v)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = item
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", x)
+}
+
+// toFloat returns the numeric value of v, ok is false if v is not a number
+func toFloat(v Value) (f float64, ok bool) {
+	switch v := v.(type) {
+	case Number:
+		return float64(v), true
+	case Integer:
+		return float64(v), true
+	case numeric:
+		return v.float()
+	}
+	return 0, false
+}
+
+// resultFloat convert the result of an evaluation for the float64 API, booleans are 1 or 0
+func resultFloat(v Value) float64 {
+	if b, ok := v.(Bool); ok {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		panic(&TypeError{Want: "number", Got: v.Kind()})
+	}
+	return f
+}
+
+// valueParams convert the params of the float64 API
+func valueParams(params map[string]float64) map[string]Value {
+	values := make(map[string]Value, len(params))
+	for k, v := range params {
+		values[k] = Number(v)
+	}
+	return values
+}
+
+// floatParams convert params for the handlers of the float64 API, values that are not numbers are left out
+func floatParams(params map[string]Value) map[string]float64 {
+	floats := make(map[string]float64, len(params))
+	for k, v := range params {
+		if f, ok := toFloat(v); ok {
+			floats[k] = f
+		}
+	}
+	return floats
+}
+
+// literal returns the value of a number literal, literals without fraction or exponent are integers
+func literal(n NumberExprNode) Value {
+	for i := 0; i < len(n.Str); i++ {
+		if n.Str[i] < '0' || n.Str[i] > '9' {
+			return Number(n.Val)
+		}
+	}
+	// below 2^53 the float64 value is exact
+	if math.Abs(n.Val) < 1<<53 {
+		return Integer(n.Val)
+	}
+	if i, err := strconv.ParseInt(n.Str, 10, 64); err == nil {
+		return Integer(i)
+	}
+	return Number(n.Val)
+}
+
+func addInt(a, b int64) (int64, bool) {
+	s := a + b
+	return s, (a^s)&(b^s) >= 0
+}
+
+func subInt(a, b int64) (int64, bool) {
+	d := a - b
+	return d, (a^b)&(a^d) >= 0
+}
+
+func mulInt(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	p := a * b
+	if p/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return p, true
+}
+
+// powInt exponentiation by squaring, b must not be negative
+func powInt(a, b int64) (int64, bool) {
+	r := int64(1)
+	for ok := true; b > 0; b >>= 1 {
+		if b&1 == 1 {
+			if r, ok = mulInt(r, a); !ok {
+				return 0, false
+			}
+		}
+		if b > 1 {
+			if a, ok = mulInt(a, a); !ok {
+				return 0, false
+			}
+		}
+	}
+	return r, true
+}
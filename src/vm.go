@@ -0,0 +1,699 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// OpCode 字节码指令
+type OpCode byte
+
+const (
+	OpConst    OpCode = iota // push Consts[Arg]
+	OpLoad                   // push params[Names[Arg]]
+	OpLoadIter               // push the iteration variable `#i` of the enclosing sum
+	OpBinary                 // pop b, a; push operators[Names[Arg]].Result(a, b)
+	OpCall                   // pop Argc values; push Names[Arg](values...)
+	OpNoerr                  // run the next Arg instructions, push 0 if they fail
+	OpSum                    // pop to, from; run the next Arg instructions for each #i in [from, to] and push the sum
+	OpLazy                   // pop a; push operators[Names[Arg]].LazyResult(a, the value of the next Argc instructions)
+	OpIf                     // pop cond; run the next Arg instructions if it is not 0, the Argc ones after them otherwise
+)
+
+var opCodeNames = [...]string{
+	OpConst:    "CONST",
+	OpLoad:     "LOAD",
+	OpLoadIter: "LOADITER",
+	OpBinary:   "BINARY",
+	OpCall:     "CALL",
+	OpNoerr:    "NOERR",
+	OpSum:      "SUM",
+	OpLazy:     "LAZY",
+	OpIf:       "IF",
+}
+
+func (op OpCode) String() string {
+	if int(op) < len(opCodeNames) {
+		return opCodeNames[op]
+	}
+	return fmt.Sprintf("OpCode(%d)", op)
+}
+
+// Instr 单条指令
+type Instr struct {
+	Op   OpCode
+	Arg  int32
+	Argc int32
+}
+
+// Bytecode 表达式编译得到的指令流
+// it only refers to functions by name, so it can be serialized and stored next to the formula
+type Bytecode struct {
+	Consts []float64
+	Names  []string
+	Code   []Instr
+	// Spans holds the source span of each instruction, the runtime errors point at them
+	Spans    []Span
+	MaxStack int
+}
+
+var bytecodeMagic = []byte("GME\x03")
+
+// CompileBytecode is a Top level function
+// compile an AST produced by the default engine into bytecode
+func CompileBytecode(expr ExprNode) (*Bytecode, error) {
+	return std.CompileBytecode(expr)
+}
+
+// CompileBytecode compile an AST produced by AST.ParseExpression into bytecode
+func (e *Engine) CompileBytecode(expr ExprNode) (*Bytecode, error) {
+	b := &bytecodeBuilder{
+		engine: e,
+		b:      &Bytecode{},
+		consts: map[float64]int32{},
+		names:  map[string]int32{},
+	}
+	if err := b.emitExpr(expr); err != nil {
+		return nil, err
+	}
+	return b.b, nil
+}
+
+type bytecodeBuilder struct {
+	engine *Engine
+	b      *Bytecode
+	consts map[float64]int32
+	names  map[string]int32
+	depth  int
+	loop   int
+}
+
+func (b *bytecodeBuilder) emit(op OpCode, arg, argc int32, span Span) int {
+	b.b.Code = append(b.b.Code, Instr{op, arg, argc})
+	b.b.Spans = append(b.b.Spans, span)
+	return len(b.b.Code) - 1
+}
+
+// push track the stack height of the instructions emitted so far
+func (b *bytecodeBuilder) push(n int) {
+	b.depth += n
+	if b.depth > b.b.MaxStack {
+		b.b.MaxStack = b.depth
+	}
+}
+
+func (b *bytecodeBuilder) constIndex(v float64) int32 {
+	// NaN never equals itself, math.Float64bits would be needed to dedupe it, so just append
+	if k, ok := b.consts[v]; ok && !math.IsNaN(v) {
+		return k
+	}
+	b.b.Consts = append(b.b.Consts, v)
+	k := int32(len(b.b.Consts) - 1)
+	b.consts[v] = k
+	return k
+}
+
+func (b *bytecodeBuilder) nameIndex(name string) int32 {
+	if k, ok := b.names[name]; ok {
+		return k
+	}
+	b.b.Names = append(b.b.Names, name)
+	k := int32(len(b.b.Names) - 1)
+	b.names[name] = k
+	return k
+}
+
+func (b *bytecodeBuilder) emitExpr(expr ExprNode) error {
+	switch n := expr.(type) {
+	case NumberExprNode:
+		b.emit(OpConst, b.constIndex(n.Val), 0, n.Span)
+		b.push(1)
+	case ConstExprNode:
+		b.emit(OpConst, b.constIndex(n.Val), 0, n.Span)
+		b.push(1)
+	case VariableExprNode:
+		if n.Val == "#i" && b.loop > 0 {
+			b.emit(OpLoadIter, 0, 0, n.Span)
+		} else {
+			b.emit(OpLoad, b.nameIndex(n.Val), 0, n.Span)
+		}
+		b.push(1)
+	case OperatorExprNode:
+		op, ok := b.engine.lookupOperator(n.Op)
+		if !ok {
+			return fmt.Errorf("bytecode: unknown operator `%s`", n.Op)
+		}
+		if err := b.emitExpr(n.Lhs); err != nil {
+			return err
+		}
+		if _, ok := op.(LazyOperator); ok {
+			// the right operand is a block run only when the operator asks for it
+			at := b.emit(OpLazy, b.nameIndex(n.Op), 0, n.Span)
+			b.push(-1)
+			if err := b.emitExpr(n.Rhs); err != nil {
+				return err
+			}
+			b.b.Code[at].Argc = int32(len(b.b.Code) - at - 1)
+			return nil
+		}
+		if err := b.emitExpr(n.Rhs); err != nil {
+			return err
+		}
+		b.emit(OpBinary, b.nameIndex(n.Op), 0, n.Span)
+		b.push(-1)
+	case FunCallerExprNode:
+		return b.emitCall(n)
+	default:
+		return fmt.Errorf("bytecode: unsupported node %T", expr)
+	}
+	return nil
+}
+
+func (b *bytecodeBuilder) emitCall(f FunCallerExprNode) error {
+	if _, ok := b.engine.lookupFunc(f.Name); !ok {
+		return &UndefinedFunctionError{Span: f.Span, Name: f.Name}
+	}
+	switch {
+	case f.Name == "noerr" && len(f.Arg) == 1:
+		at := b.emit(OpNoerr, 0, 0, f.Span)
+		if err := b.emitExpr(f.Arg[0]); err != nil {
+			return err
+		}
+		b.b.Code[at].Arg = int32(len(b.b.Code) - at - 1)
+		return nil
+	case f.Name == "if" && len(f.Arg) == 3:
+		if err := b.emitExpr(f.Arg[0]); err != nil {
+			return err
+		}
+		at := b.emit(OpIf, 0, 0, f.Span)
+		b.push(-1)
+		if err := b.emitExpr(f.Arg[1]); err != nil {
+			return err
+		}
+		// both branches start from the same height, only one of them runs
+		b.push(-1)
+		b.b.Code[at].Arg = int32(len(b.b.Code) - at - 1)
+		if err := b.emitExpr(f.Arg[2]); err != nil {
+			return err
+		}
+		b.b.Code[at].Argc = int32(len(b.b.Code) - at - 1 - int(b.b.Code[at].Arg))
+		return nil
+	case f.Name == "sum" && len(f.Arg) == 3:
+		start, ok1 := f.Arg[0].(NumberExprNode)
+		end, ok2 := f.Arg[1].(NumberExprNode)
+		if !ok1 || !ok2 {
+			return errors.New("calling function `sum` cannot be computed efficiently")
+		}
+		b.emit(OpConst, b.constIndex(start.Val), 0, start.Span)
+		b.emit(OpConst, b.constIndex(end.Val), 0, end.Span)
+		b.push(2)
+		at := b.emit(OpSum, 0, 0, f.Span)
+		b.push(-2)
+		b.loop++
+		err := b.emitExpr(f.Arg[2])
+		b.loop--
+		if err != nil {
+			return err
+		}
+		b.push(-1)
+		b.b.Code[at].Arg = int32(len(b.b.Code) - at - 1)
+		b.push(1)
+		return nil
+	}
+	for _, arg := range f.Arg {
+		if err := b.emitExpr(arg); err != nil {
+			return err
+		}
+	}
+	b.emit(OpCall, b.nameIndex(f.Name), int32(len(f.Arg)), f.Span)
+	b.push(1 - len(f.Arg))
+	return nil
+}
+
+// String disassemble the bytecode, one instruction per line
+func (b *Bytecode) String() string {
+	var sb strings.Builder
+	for pc, in := range b.Code {
+		fmt.Fprintf(&sb, "%04d %-8s", pc, in.Op)
+		switch in.Op {
+		case OpConst:
+			fmt.Fprintf(&sb, " %s", Float64ToStr(b.Consts[in.Arg]))
+		case OpLoad:
+			fmt.Fprintf(&sb, " %s", b.Names[in.Arg])
+		case OpBinary:
+			fmt.Fprintf(&sb, " %s", b.Names[in.Arg])
+		case OpCall:
+			fmt.Fprintf(&sb, " %s/%d", b.Names[in.Arg], in.Argc)
+		case OpNoerr, OpSum:
+			fmt.Fprintf(&sb, " +%d", in.Arg)
+		case OpLazy:
+			fmt.Fprintf(&sb, " %s +%d", b.Names[in.Arg], in.Argc)
+		case OpIf:
+			fmt.Fprintf(&sb, " +%d +%d", in.Arg, in.Argc)
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// MarshalBinary encode the bytecode into a compact binary form
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(bytecodeMagic)
+	putUvarint(buf, uint64(b.MaxStack))
+	putUvarint(buf, uint64(len(b.Consts)))
+	for _, v := range b.Consts {
+		var w [8]byte
+		binary.LittleEndian.PutUint64(w[:], math.Float64bits(v))
+		buf.Write(w[:])
+	}
+	putUvarint(buf, uint64(len(b.Names)))
+	for _, name := range b.Names {
+		putUvarint(buf, uint64(len(name)))
+		buf.WriteString(name)
+	}
+	putUvarint(buf, uint64(len(b.Code)))
+	for _, in := range b.Code {
+		buf.WriteByte(byte(in.Op))
+		putUvarint(buf, uint64(in.Arg))
+		if in.Op == OpCall || in.Op == OpLazy || in.Op == OpIf {
+			putUvarint(buf, uint64(in.Argc))
+		}
+	}
+	putUvarint(buf, uint64(len(b.Spans)))
+	for _, span := range b.Spans {
+		putUvarint(buf, uint64(span.Start))
+		putUvarint(buf, uint64(span.End))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decode data produced by MarshalBinary and validate it
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(bytecodeMagic))
+	if _, err := r.Read(magic); err != nil || !bytes.Equal(magic, bytecodeMagic) {
+		return errors.New("bytecode: bad magic")
+	}
+	var nb Bytecode
+	maxStack, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("bytecode: %w", err)
+	}
+	nb.MaxStack = int(maxStack)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return errors.New("bytecode: bad constant table")
+	}
+	nb.Consts = make([]float64, n)
+	for k := range nb.Consts {
+		var w [8]byte
+		if _, err := io.ReadFull(r, w[:]); err != nil {
+			return fmt.Errorf("bytecode: %w", err)
+		}
+		nb.Consts[k] = math.Float64frombits(binary.LittleEndian.Uint64(w[:]))
+	}
+	n, err = binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return errors.New("bytecode: bad name table")
+	}
+	nb.Names = make([]string, n)
+	for k := range nb.Names {
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return errors.New("bytecode: bad name table")
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return fmt.Errorf("bytecode: %w", err)
+		}
+		nb.Names[k] = string(name)
+	}
+	n, err = binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return errors.New("bytecode: bad code")
+	}
+	nb.Code = make([]Instr, n)
+	for k := range nb.Code {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("bytecode: %w", err)
+		}
+		arg, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("bytecode: %w", err)
+		}
+		nb.Code[k] = Instr{Op: OpCode(op), Arg: int32(arg)}
+		if op := OpCode(op); op == OpCall || op == OpLazy || op == OpIf {
+			argc, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("bytecode: %w", err)
+			}
+			nb.Code[k].Argc = int32(argc)
+		}
+	}
+	// the spans are optional, a Bytecode built by hand may have none
+	n, err = binary.ReadUvarint(r)
+	if err != nil || n != 0 && n != uint64(len(nb.Code)) {
+		return errors.New("bytecode: bad span table")
+	}
+	nb.Spans = make([]Span, n)
+	for k := range nb.Spans {
+		start, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("bytecode: %w", err)
+		}
+		end, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("bytecode: %w", err)
+		}
+		nb.Spans[k] = Span{int(start), int(end)}
+	}
+	// the stack can never be higher than the number of instructions
+	if nb.MaxStack > len(nb.Code) {
+		return errors.New("bytecode: bad stack size")
+	}
+	if err := nb.validate(); err != nil {
+		return err
+	}
+	*b = nb
+	return nil
+}
+
+// validate check the operand references and the stack height of every instruction,
+// so a VM never indexes out of range on a corrupted artifact
+func (b *Bytecode) validate() error {
+	depth, err := b.validateRange(0, len(b.Code), 0, false)
+	if err != nil {
+		return err
+	}
+	if depth != 1 {
+		return errors.New("bytecode: expression must leave exactly one value")
+	}
+	return nil
+}
+
+func (b *Bytecode) validateRange(from, to, depth int, loop bool) (int, error) {
+	for pc := from; pc < to; pc++ {
+		in := b.Code[pc]
+		switch in.Op {
+		case OpConst:
+			if in.Arg < 0 || int(in.Arg) >= len(b.Consts) {
+				return 0, fmt.Errorf("bytecode: bad constant at %d", pc)
+			}
+			depth++
+		case OpLoad:
+			if in.Arg < 0 || int(in.Arg) >= len(b.Names) {
+				return 0, fmt.Errorf("bytecode: bad name at %d", pc)
+			}
+			depth++
+		case OpLoadIter:
+			if !loop {
+				return 0, fmt.Errorf("bytecode: `#i` outside of sum at %d", pc)
+			}
+			depth++
+		case OpBinary:
+			// the operators registered by RegOperator are resolved by the VM
+			if in.Arg < 0 || int(in.Arg) >= len(b.Names) {
+				return 0, fmt.Errorf("bytecode: bad operator at %d", pc)
+			}
+			if depth < 2 {
+				return 0, fmt.Errorf("bytecode: stack underflow at %d", pc)
+			}
+			depth--
+		case OpCall:
+			if in.Arg < 0 || int(in.Arg) >= len(b.Names) || in.Argc < 0 || int(in.Argc) > depth {
+				return 0, fmt.Errorf("bytecode: bad call at %d", pc)
+			}
+			depth = depth - int(in.Argc) + 1
+		case OpLazy:
+			end := pc + 1 + int(in.Argc)
+			// the operator is resolved by the VM like the one of OpBinary
+			if in.Arg < 0 || int(in.Arg) >= len(b.Names) || in.Argc < 0 || end > to {
+				return 0, fmt.Errorf("bytecode: bad block at %d", pc)
+			}
+			if depth < 1 {
+				return 0, fmt.Errorf("bytecode: stack underflow at %d", pc)
+			}
+			d, err := b.validateRange(pc+1, end, depth-1, loop)
+			if err != nil {
+				return 0, err
+			}
+			if d != depth {
+				return 0, fmt.Errorf("bytecode: block at %d must leave exactly one value", pc)
+			}
+			pc = end - 1
+		case OpIf:
+			mid := pc + 1 + int(in.Arg)
+			end := mid + int(in.Argc)
+			if in.Arg < 0 || in.Argc < 0 || end > to {
+				return 0, fmt.Errorf("bytecode: bad block at %d", pc)
+			}
+			if depth < 1 {
+				return 0, fmt.Errorf("bytecode: stack underflow at %d", pc)
+			}
+			for _, block := range [][2]int{{pc + 1, mid}, {mid, end}} {
+				d, err := b.validateRange(block[0], block[1], depth-1, loop)
+				if err != nil {
+					return 0, err
+				}
+				if d != depth {
+					return 0, fmt.Errorf("bytecode: block at %d must leave exactly one value", block[0])
+				}
+			}
+			pc = end - 1
+		case OpNoerr, OpSum:
+			end := pc + 1 + int(in.Arg)
+			if in.Arg < 0 || end > to {
+				return 0, fmt.Errorf("bytecode: bad block at %d", pc)
+			}
+			base := depth
+			if in.Op == OpSum {
+				if depth < 2 {
+					return 0, fmt.Errorf("bytecode: stack underflow at %d", pc)
+				}
+				base = depth - 2
+			}
+			d, err := b.validateRange(pc+1, end, base, loop || in.Op == OpSum)
+			if err != nil {
+				return 0, err
+			}
+			if d != base+1 {
+				return 0, fmt.Errorf("bytecode: block at %d must leave exactly one value", pc)
+			}
+			depth = d
+			pc = end - 1
+		default:
+			return 0, fmt.Errorf("bytecode: unknown opcode %d at %d", in.Op, pc)
+		}
+		if depth > b.MaxStack {
+			return 0, fmt.Errorf("bytecode: stack overflow at %d", pc)
+		}
+	}
+	return depth, nil
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var w [binary.MaxVarintLen64]byte
+	buf.Write(w[:binary.PutUvarint(w[:], v)])
+}
+
+// VM 字节码虚拟机
+// a VM only holds settings, Run can be called from multiple goroutines
+type VM struct {
+	engine *Engine
+	// MaxSteps limit the number of executed instructions, 0 means unlimited
+	MaxSteps int
+}
+
+// NewVM create a virtual machine resolving functions and operators with the engine e,
+// the default engine if e is nil
+func NewVM(e *Engine) *VM {
+	if e == nil {
+		e = std
+	}
+	return &VM{engine: e}
+}
+
+// Run execute the bytecode with params
+// err is not nil if an arithmetic runtime error occurs or the step budget is exhausted,
+// the runtime errors point at the span of the instruction that raised them
+func (vm *VM) Run(b *Bytecode, params map[string]float64) (r float64, err error) {
+	s := &vmState{
+		vm:     vm,
+		engine: vm.engine,
+		b:      b,
+		params: params,
+		stack:  make([]float64, 0, b.MaxStack),
+	}
+	if s.engine == nil {
+		// the zero VM uses the default engine like NewVM(nil)
+		s.engine = std
+	}
+	defer func() {
+		if rec := recover(); rec != nil {
+			if l, ok := rec.(locatable); ok {
+				l.locate(s.span())
+			}
+			err = rec.(error)
+		}
+	}()
+	s.exec(0, len(b.Code))
+	return s.stack[len(s.stack)-1], nil
+}
+
+type vmState struct {
+	vm     *VM
+	engine *Engine
+	b      *Bytecode
+	params map[string]float64
+	stack  []float64
+	steps  int
+	iter   float64
+	loop   int
+	// pc is the instruction being executed
+	pc int
+}
+
+// span returns the source span of the instruction being executed, empty if b has no spans
+func (s *vmState) span() Span {
+	if s.pc < len(s.b.Spans) {
+		return s.b.Spans[s.pc]
+	}
+	return Span{}
+}
+
+func (s *vmState) pop() float64 {
+	v := s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+	return v
+}
+
+func (s *vmState) exec(from, to int) {
+	for pc := from; pc < to; pc++ {
+		s.steps++
+		if s.vm.MaxSteps > 0 && s.steps > s.vm.MaxSteps {
+			panic(ErrStepLimit)
+		}
+		s.pc = pc
+		in := s.b.Code[pc]
+		switch in.Op {
+		case OpConst:
+			s.stack = append(s.stack, s.b.Consts[in.Arg])
+		case OpLoad:
+			s.stack = append(s.stack, s.params[s.b.Names[in.Arg]])
+		case OpLoadIter:
+			s.stack = append(s.stack, s.iter)
+		case OpBinary:
+			rh := s.pop()
+			lh := s.pop()
+			s.stack = append(s.stack, s.operator(s.b.Names[in.Arg]).Result(lh, rh))
+		case OpCall:
+			s.call(s.b.Names[in.Arg], int(in.Argc))
+		case OpNoerr:
+			end := pc + 1 + int(in.Arg)
+			s.noerr(pc+1, end)
+			pc = end - 1
+		case OpSum:
+			end := pc + 1 + int(in.Arg)
+			s.sum(pc+1, end)
+			pc = end - 1
+		case OpIf:
+			mid := pc + 1 + int(in.Arg)
+			end := mid + int(in.Argc)
+			if s.pop() != 0 {
+				s.exec(pc+1, mid)
+			} else {
+				s.exec(mid, end)
+			}
+			pc = end - 1
+		case OpLazy:
+			end := pc + 1 + int(in.Argc)
+			s.lazy(s.b.Names[in.Arg], pc+1, end)
+			pc = end - 1
+		}
+	}
+}
+
+// operator resolve an operator with the engine of the VM
+func (s *vmState) operator(name string) OperatorUnit {
+	op, ok := s.engine.lookupOperator(name)
+	if !ok {
+		panic(fmt.Errorf("bytecode: unknown operator `%s`", name))
+	}
+	return op
+}
+
+// call evaluate a function with already evaluated arguments
+func (s *vmState) call(name string, argc int) {
+	def, ok := s.engine.lookupFunc(name)
+	if !ok {
+		panic(&UndefinedFunctionError{Name: name})
+	}
+	if def.argc >= 0 && argc != def.argc {
+		panic(&ArityError{Name: name, Want: def.argc, Got: argc})
+	}
+	args := make([]ExprNode, argc)
+	for k := argc - 1; k >= 0; k-- {
+		v := s.pop()
+		args[k] = NumberExprNode{Val: v, Str: Float64ToStr(v)}
+	}
+	params := s.params
+	if s.loop > 0 {
+		params = privateScope(params)
+		params["#i"] = s.iter
+	}
+	s.stack = append(s.stack, resultFloat(def.fun(s.engine.newFloatEvaluator(nil), valueParams(params), args...)))
+}
+
+func (s *vmState) noerr(from, to int) {
+	height := len(s.stack)
+	defer func() {
+		if rec := recover(); rec != nil {
+			if aborted(rec) {
+				panic(rec)
+			}
+			s.stack = append(s.stack[:height], 0)
+		}
+	}()
+	s.exec(from, to)
+}
+
+// lazy apply the operator name to the top of the stack and the block [from, to), which is only run if it needs it
+func (s *vmState) lazy(name string, from, to int) {
+	op, ok := s.operator(name).(LazyOperator)
+	if !ok {
+		panic(fmt.Errorf("bytecode: operator `%s` does not short-circuit", name))
+	}
+	a, at := s.pop(), s.pc
+	r := op.LazyResult(
+		func() float64 { return a },
+		func() float64 {
+			s.exec(from, to)
+			s.pc = at
+			return s.pop()
+		},
+	)
+	s.stack = append(s.stack, r)
+}
+
+func (s *vmState) sum(from, to int) {
+	end := s.pop()
+	start := s.pop()
+	iter := s.iter
+	s.loop++
+	sumV := 0.0
+	for i := int(start); i <= int(end); i++ {
+		s.iter = float64(i)
+		s.exec(from, to)
+		sumV = decimalAdd(sumV, s.pop())
+	}
+	s.loop--
+	s.iter = iter
+	s.stack = append(s.stack, sumV)
+}
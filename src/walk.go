@@ -0,0 +1,54 @@
+package engine
+
+// Visitor 遍历器
+// Visit is invoked for each node encountered by Walk,
+// if the result visitor w is not nil, Walk visits each of the children of node with w, followed by a call of w.Visit(nil)
+type Visitor interface {
+	Visit(node ExprNode) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order, works with any node kind implementing ExprNode
+func Walk(v Visitor, node ExprNode) {
+	if node == nil {
+		return
+	}
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, child := range node.Children() {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(ExprNode) bool
+
+func (f inspector) Visit(node ExprNode) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: it starts by calling f(node),
+// if f returns true, Inspect invokes f recursively for each of the children of node, followed by a call of f(nil)
+func Inspect(node ExprNode, f func(ExprNode) bool) {
+	Walk(inspector(f), node)
+}
+
+// Rewrite transforms an AST bottom-up: the children of node are rewritten first,
+// then f is called with the rebuilt node and its result replaces it.
+// the original tree is left untouched
+func Rewrite(node ExprNode, f func(ExprNode) ExprNode) ExprNode {
+	if node == nil {
+		return nil
+	}
+	if children := node.Children(); len(children) > 0 {
+		rewritten := make([]ExprNode, len(children))
+		for i, child := range children {
+			rewritten[i] = Rewrite(child, f)
+		}
+		node = node.WithChildren(rewritten)
+	}
+	return f(node)
+}